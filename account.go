@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Accounts are the WhatsApp numbers served by the bot, each a device of the
+// whatsmeow store with its own owner, model, persona, commands, roles, invites and
+// chat settings. The first account keeps the conversations, roles and settings of
+// the single number bot; the others prefix their conversations with their name.
+
+// AccountConfig is a WhatsApp number in the configuration
+type AccountConfig struct {
+	Name        string   `yaml:"name"`         // Used by the command line and in the logs
+	Phone       string   `yaml:"phone"`        // The account's own number without +, to find its device and pair with a code
+	Number      string   `yaml:"number"`       // Owner of this account; "" is the top-level number
+	Model       string   `yaml:"model"`        // "" is the top-level model
+	VisionModel string   `yaml:"vision_model"` // "" is the top-level vision model
+	Persona     string   `yaml:"persona"`      // Persona of the chats that chose none; "" is the top-level persona
+	Commands    []string `yaml:"commands"`     // Commands and routes available; empty allows all
+}
+
+// Account is a WhatsApp number and its connection
+type Account struct {
+	AccountConfig
+	primary bool
+
+	mu             sync.Mutex
+	client         *whatsmeow.Client // Replaced when the account is paired again
+	disconnectedAt time.Time         // Zero while connected
+	offline        string            // Why the account stays offline on purpose, "" if it does not
+	notices        []string          // For the owner, sent once connected
+}
+
+var (
+	accounts  []*Account          // In configuration order; the first is the primary one
+	container *sqlstore.Container // WhatsApp devices of every account
+)
+
+// primaryAccount sends what does not come from a chat: MQTT messages, API calls without an account
+func primaryAccount() *Account {
+	return accounts[0]
+}
+
+// countAccounts counts the accounts whose client satisfies is
+func countAccounts(is func(*whatsmeow.Client) bool) int {
+	n := 0
+	for _, a := range accounts {
+		if client := a.Client(); client != nil && is(client) {
+			n++
+		}
+	}
+	return n
+}
+
+// findAccount returns the account called name; "" is the primary account
+func findAccount(name string) (*Account, bool) {
+	for _, a := range accounts {
+		if a.Key() == name || strings.EqualFold(a.Name, name) {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// NewAccounts returns the accounts of cfg: the configured ones, or one made of
+// the top-level settings. Call it once the commands are registered.
+func NewAccounts(cfg Config) ([]*Account, error) {
+	configs := cfg.Accounts
+	if len(configs) == 0 {
+		configs = []AccountConfig{{Name: "default"}}
+	}
+	var list []*Account
+	for i, c := range configs {
+		if c.Number == "" {
+			c.Number = cfg.Number
+		}
+		if c.Model == "" {
+			c.Model = cfg.Model
+		}
+		if c.VisionModel == "" {
+			c.VisionModel = cfg.VisionModel
+		}
+		if c.Persona == "" {
+			c.Persona = cfg.Persona
+		}
+		for _, name := range c.Commands {
+			if !isCommandOrRoute(name) {
+				return nil, fmt.Errorf("accounts.%s.commands: unknown command %q", c.Name, name)
+			}
+		}
+		list = append(list, &Account{AccountConfig: c, primary: i == 0})
+	}
+	return list, nil
+}
+
+func isCommandOrRoute(name string) bool {
+	if cmd, ok := commands[strings.ToLower(name)]; ok && cmd.Name == name {
+		return true
+	}
+	for _, route := range routes {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Key is what the account's data is stored under: "" for the primary account, which
+// keeps the data of the single number bot, else its name
+func (a *Account) Key() string {
+	if a.primary {
+		return ""
+	}
+	return a.Name
+}
+
+// HistoryKey is the conversation of chat with this account
+func (a *Account) HistoryKey(chat types.JID) string {
+	if a.primary {
+		return chat.String()
+	}
+	return a.Name + ":" + chat.String()
+}
+
+// SettingKey is the chat setting key on this account: the primary account keeps
+// the settings of the single number bot, the others add their name
+func (a *Account) SettingKey(key string) string {
+	if a.primary {
+		return key
+	}
+	return key + "." + a.Name
+}
+
+// IsOwner reports whether jid is the configured owner of the account
+func (a *Account) IsOwner(jid types.JID) bool {
+	jid = jid.ToNonAD()
+	return a.Number != "" && jid.User == a.Number && jid.Server == types.DefaultUserServer
+}
+
+// LevelOf returns the level of a contact writing to this account
+func (a *Account) LevelOf(jid types.JID) Level {
+	if a.IsOwner(jid) {
+		return LevelOwner
+	}
+	return roles.LevelOf(a.Key(), jid)
+}
+
+// Allows reports whether the command or route name is available on this account
+func (a *Account) Allows(name string) bool {
+	return len(a.Commands) == 0 || matchesAny(name, a.Commands)
+}
+
+// pairPhone is the number a pairing code is asked for, "" to pair with the QR code
+func (a *Account) pairPhone() string {
+	if a.Phone == "" && a.primary {
+		return config.Pairing.Phone
+	}
+	return a.Phone
+}
+
+// openContainer opens the whatsmeow store, once
+func openContainer() error {
+	if container != nil {
+		return nil
+	}
+	dbLog := waLog.Stdout("Database", "INFO", true)
+	var err error
+	container, err = sqlstore.New("sqlite3", "file:"+config.AccountsDB+"?_foreign_keys=on", dbLog)
+	return err
+}
+
+// device returns the device of the account, a new one if it is not paired
+func (a *Account) device() (*store.Device, error) {
+	if a.Phone == "" {
+		return container.GetFirstDevice()
+	}
+	devices, err := container.GetAllDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.ID != nil && device.ID.User == a.Phone {
+			return device, nil
+		}
+	}
+	return container.NewDevice(), nil
+}
+
+// Client returns the WhatsApp client of the account, nil before NewClient
+func (a *Account) Client() *whatsmeow.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+// NewClient creates the client of the account and makes it the account's. With
+// serve the bot handles its events; the command line only pairs it.
+func (a *Account) NewClient(serve bool) error {
+	if err := openContainer(); err != nil {
+		return err
+	}
+	device, err := a.device()
+	if err != nil {
+		return err
+	}
+	clientLog := waLog.Stdout("Client "+a.Name, "INFO", true)
+	client := whatsmeow.NewClient(device, clientLog)
+	if serve {
+		client.AddEventHandler(func(evt interface{}) { HandleEvent(a, evt) })
+	}
+	a.mu.Lock()
+	a.client = client
+	a.mu.Unlock()
+	return nil
+}
+
+// Connect connects the account, pairing it first if it has no session
+func (a *Account) Connect() {
+	client := a.Client()
+	if client.Store.ID == nil {
+		Pair(a)
+	}
+	// After pairing whatsmeow is usually connected already
+	if err := client.Connect(); err != nil && !errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+		log.Printf("Cannot connect %s: %v", a.Name, err)
+	}
+}
+
+// RunAccountCommand runs a subcommand of the command line: accounts, pair or remove
+func RunAccountCommand(args []string) error {
+	if err := openContainer(); err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "accounts" && len(args) == 1:
+		devices, err := container.GetAllDevices()
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			state := "not paired"
+			if device, err := a.device(); err != nil {
+				return err
+			} else if device.ID != nil {
+				state = "paired as " + device.ID.ToNonAD().User
+			}
+			fmt.Printf("%s\t%s\towner %s, model %s\n", a.Name, state, a.Number, a.Model)
+		}
+		for _, device := range devices {
+			known := false
+			for _, a := range accounts {
+				known = known || a.Phone == device.ID.User || (a.Phone == "" && device == devices[0])
+			}
+			if !known {
+				fmt.Printf("-\t%s is paired but in no account, remove it with: remove %s\n", device.ID.ToNonAD().User, device.ID.ToNonAD().User)
+			}
+		}
+		return nil
+
+	case args[0] == "pair" && len(args) == 2:
+		a, ok := findAccount(args[1])
+		if !ok {
+			return fmt.Errorf("no account %s in the configuration", args[1])
+		}
+		if err := a.NewClient(false); err != nil {
+			return err
+		}
+		client := a.Client()
+		if client.Store.ID != nil {
+			return fmt.Errorf("%s is already paired as %s, remove it first", a.Name, client.Store.ID.ToNonAD().User)
+		}
+		Pair(a)
+		client.Disconnect()
+		fmt.Printf("%s paired as %s\n", a.Name, client.Store.ID.ToNonAD().User)
+		return nil
+
+	case args[0] == "remove" && len(args) == 2:
+		var device *store.Device
+		if a, ok := findAccount(args[1]); ok {
+			var err error
+			if device, err = a.device(); err != nil {
+				return err
+			}
+		} else {
+			// A device left by an account no longer configured
+			devices, err := container.GetAllDevices()
+			if err != nil {
+				return err
+			}
+			for _, d := range devices {
+				if d.ID.User == args[1] {
+					device = d
+				}
+			}
+		}
+		if device == nil || device.ID == nil {
+			return fmt.Errorf("%s is not paired", args[1])
+		}
+		client := whatsmeow.NewClient(device, waLog.Stdout("Client", "WARN", true))
+		jid := device.ID.ToNonAD().User
+		// Unlink from the phone too if possible, else just forget the session
+		if err := client.Connect(); err == nil && client.WaitForConnection(15*time.Second) {
+			err := client.Logout()
+			if err == nil {
+				fmt.Printf("%s unlinked and removed\n", jid)
+				return nil
+			}
+			log.Printf("Cannot log out %s, removing the session only: %v", jid, err)
+		}
+		client.Disconnect()
+		if err := device.Delete(); err != nil {
+			return err
+		}
+		fmt.Printf("%s removed; unlink it in the phone too, under Linked devices\n", jid)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q; use: accounts, pair <account>, remove <account>", strings.Join(args, " "))
+}
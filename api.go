@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The API lets other programs on the Pi (the AQI bot, the stock scripts) use the
+// bot's WhatsApp session and model directly, instead of chat conventions.
+// Every request needs the header Authorization: Bearer <http.token>.
+
+const (
+	apiMaxBody     = 32 << 20 // Media up to WhatsApp's limits, base64 encoded
+	apiSendTimeout = 2 * time.Minute
+)
+
+// requireToken lets a request through only with the configured bearer token
+func requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.HTTP.Token == "" {
+			writeError(w, http.StatusForbidden, "the API is disabled, set http.token in the configuration")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.HTTP.Token)) != 1 {
+			log.Printf("API: refused %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, apiMaxBody)
+		next(w, r)
+	}
+}
+
+// decodeRequest reads the JSON body of r into v, answering the error itself
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "bad JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeAIError answers a failed AI request, as aiErrorReply does in WhatsApp
+func writeAIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, ErrBackendUnavailable):
+		status = http.StatusBadGateway
+	case errors.As(err, &statusErr) && statusErr.Temporary():
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, aiErrorReply(err))
+}
+
+// apiAccount finds the account named in a request, writing the error if there is none
+func apiAccount(w http.ResponseWriter, name string) (*Account, bool) {
+	a, ok := findAccount(name)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "account: no account "+name)
+	}
+	return a, ok
+}
+
+// apiSend sends a text, or a file with an optional caption, from the primary account or the one named:
+// {"jid": "393331234567", "text": "hello"}
+// {"jid": "...@g.us", "media": "<base64>", "mimetype": "image/png", "filename": "chart.png", "text": "caption", "account": "shop"}
+func apiSend(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Account  string `json:"account"`
+		JID      string `json:"jid"` // Phone number or JID, groups included
+		Text     string `json:"text"`
+		Media    []byte `json:"media"` // base64 in JSON
+		Mimetype string `json:"mimetype"`
+		FileName string `json:"filename"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	chat, err := ParseContact(req.JID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "jid: "+err.Error())
+		return
+	}
+	if req.Text == "" && len(req.Media) == 0 {
+		writeError(w, http.StatusBadRequest, "nothing to send, give text or media")
+		return
+	}
+	account, ok := apiAccount(w, req.Account)
+	if !ok {
+		return
+	}
+
+	if !account.Client().IsLoggedIn() {
+		writeError(w, http.StatusServiceUnavailable, "WhatsApp is not connected")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), apiSendTimeout)
+	defer cancel()
+	msg := &waE2E.Message{Conversation: &req.Text}
+	if len(req.Media) > 0 {
+		if msg, err = account.mediaMessage(ctx, req.Media, req.Mimetype, req.FileName, req.Text); err != nil {
+			log.Printf("API: cannot upload media for %s: %v", chat, err)
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	resp, err := account.SendMessage(ctx, chat, msg)
+	if err != nil {
+		log.Printf("API: cannot send to %s: %v", chat, err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	log.Printf("API: sent message %s to %s", resp.ID, chat)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": resp.ID, "timestamp": resp.Timestamp})
+}
+
+// apiGenerate runs a single generation task, like the TITLE: route, with the model of the primary account or the one named:
+// {"prompt": "...", "account": "shop"} -> {"response": "..."}
+func apiGenerate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Account string `json:"account"`
+		Prompt  string `json:"prompt"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		writeError(w, http.StatusBadRequest, "empty prompt")
+		return
+	}
+	account, ok := apiAccount(w, req.Account)
+	if !ok {
+		return
+	}
+	response, err := GenerateAI(account.PersonaOf(types.EmptyJID).Model, req.Prompt)
+	if err != nil {
+		log.Printf("API: AI generate failed: %v", err)
+		writeAIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"response": response})
+}
+
+// apiChat continues a conversation with the model, kept like WhatsApp conversations:
+// {"conversation": "stocks", "text": "...", "account": "shop"} -> {"response": "..."}
+func apiChat(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Account      string `json:"account"`      // Whose model and prompt answer; "" is the primary account
+		Conversation string `json:"conversation"` // Any name; "" is the conversation "default"
+		Text         string `json:"text"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		writeError(w, http.StatusBadRequest, "empty text")
+		return
+	}
+	if req.Conversation == "" {
+		req.Conversation = "default"
+	}
+	account, ok := apiAccount(w, req.Account)
+	if !ok {
+		return
+	}
+	key := "api:" + req.Conversation
+	if account.Key() != "" {
+		key = account.Key() + ":" + key
+	}
+	// The token is the owner's: the model gets every tool
+	response, err := ChatAIStream(key, account.PersonaOf(types.EmptyJID), LevelOwner, ChatMessage{Role: "user", Content: req.Text}, nil)
+	if err != nil {
+		log.Printf("API: AI chat for %s failed: %v", req.Conversation, err)
+		writeAIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"response": response})
+}
+
+func init() {
+	httpMux.HandleFunc("POST /send", requireToken(apiSend))
+	httpMux.HandleFunc("POST /generate", requireToken(apiGenerate))
+	httpMux.HandleFunc("POST /chat", requireToken(apiChat))
+}
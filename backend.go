@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ChatMessage is a single turn of a conversation, as sent to the backend
+type ChatMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  [][]byte `json:"images,omitempty"` // Encoded as base64, as /api/chat expects
+
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // Tools the assistant wants to run
+	ToolName   string     `json:"tool_name,omitempty"`    // For role "tool": the tool whose result this is
+	ToolCallID string     `json:"tool_call_id,omitempty"` // For role "tool": the call answered, if it had an ID
+}
+
+// ToolCall is the model asking for a tool to be run, in the /api/chat format
+type ToolCall struct {
+	ID       string `json:"id,omitempty"`
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// ToolSpec describes a tool the model may call
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{} // JSON schema of the arguments
+}
+
+// toolsPayload is specs in the "tools" format shared by Ollama and OpenAI
+func toolsPayload(specs []ToolSpec) []map[string]interface{} {
+	var tools []map[string]interface{}
+	for _, spec := range specs {
+		tools = append(tools, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        spec.Name,
+				"description": spec.Description,
+				"parameters":  spec.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+// HasImages reports whether any of messages carries an image
+func HasImages(messages []ChatMessage) bool {
+	for _, msg := range messages {
+		if len(msg.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ChatRequest is what ChatAI hands to a backend for one turn
+type ChatRequest struct {
+	Model    string
+	Messages []ChatMessage
+	Tools    []ToolSpec // Tools the model may call instead of answering
+	// Sampling temperature; nil leaves the backend's default
+	Temperature *float64
+}
+
+// ChatResponse is the assistant's answer to a ChatRequest
+type ChatResponse struct {
+	Content   string
+	ToolCalls []ToolCall // Tools to run and send back before the final answer
+	Usage
+}
+
+// Usage is the number of tokens a request took, when the backend reports it
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// toolsUnsupported reports whether err means the model cannot be given tools
+func toolsUnsupported(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(strings.ToLower(statusErr.Body), "support tools")
+}
+
+// LLMBackend is an inference server the bot can talk to
+type LLMBackend interface {
+	Chat(ctx context.Context, req ChatRequest) (ChatResponse, error)
+	// ChatStream is like Chat, but calls onToken with every piece of the answer as it is generated
+	ChatStream(ctx context.Context, req ChatRequest, onToken func(token string)) (ChatResponse, error)
+	Generate(ctx context.Context, model, prompt string) (string, Usage, error)
+	// Embed returns the embedding vector of text, computed by model
+	Embed(ctx context.Context, model, text string) ([]float32, error)
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// ErrBackendUnavailable means the backend could not be reached at all
+var ErrBackendUnavailable = errors.New("AI backend unavailable")
+
+// StatusError is a non-200 answer from the backend
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s: %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Temporary reports whether the same request may succeed later (overload, restart, model loading)
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ResponseError means the backend answered, but the body could not be read or understood
+type ResponseError struct {
+	Err error
+}
+
+func (e *ResponseError) Error() string { return "bad AI backend response: " + e.Err.Error() }
+func (e *ResponseError) Unwrap() error { return e.Err }
+
+// NewBackend returns the backend selected with -backend, pointed at url
+func NewBackend(kind, url, apiKey string) (LLMBackend, error) {
+	switch strings.ToLower(kind) {
+	case "", "ollama":
+		if url == "" {
+			url = "http://localhost:11434"
+		}
+		return &OllamaBackend{BaseURL: strings.TrimRight(url, "/")}, nil
+	case "openai":
+		if url == "" {
+			url = "http://localhost:8080/v1"
+		}
+		return &OpenAIBackend{BaseURL: strings.TrimRight(url, "/"), APIKey: apiKey}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (use ollama or openai)", kind)
+}
+
+// postJSON sends payload to url and returns the response, which the caller must close
+func postJSON(ctx context.Context, url, apiKey string, payload interface{}) (*http.Response, error) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return resp, nil
+}
+
+// getJSON fetches url and decodes the JSON body into out
+func getJSON(ctx context.Context, url, apiKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &StatusError{URL: url, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &ResponseError{Err: err}
+	}
+	return nil
+}
+
+// ollamaUsage are the token counts in the last object of an Ollama response
+type ollamaUsage struct {
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+func (u ollamaUsage) usage() Usage {
+	return Usage{PromptTokens: u.PromptEvalCount, CompletionTokens: u.EvalCount}
+}
+
+// OllamaBackend talks to the native Ollama API (/api/chat, /api/generate, /api/embeddings, /api/tags)
+type OllamaBackend struct {
+	BaseURL string
+}
+
+func (o *OllamaBackend) Chat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+		"stream":   false, // Full response instead of streaming
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = toolsPayload(req.Tools)
+	}
+	if req.Temperature != nil {
+		payload["options"] = map[string]float64{"temperature": *req.Temperature}
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/api/chat", "", payload)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Message ChatMessage `json:"message"`
+		ollamaUsage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ChatResponse{}, &ResponseError{Err: fmt.Errorf("parse chat response: %w", err)}
+	}
+	return ChatResponse{Content: result.Message.Content, ToolCalls: result.Message.ToolCalls, Usage: result.usage()}, nil
+}
+
+func (o *OllamaBackend) ChatStream(ctx context.Context, req ChatRequest, onToken func(token string)) (ChatResponse, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+		"stream":   true,
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = toolsPayload(req.Tools)
+	}
+	if req.Temperature != nil {
+		payload["options"] = map[string]float64{"temperature": *req.Temperature}
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/api/chat", "", payload)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	// Same NDJSON framing as /api/generate, with the piece in message.content
+	scanner := bufio.NewScanner(resp.Body)
+	var content strings.Builder
+	var toolCalls []ToolCall
+	var usage Usage
+	for scanner.Scan() {
+		var chunk struct {
+			Message ChatMessage `json:"message"`
+			Done    bool        `json:"done"`
+			Error   string      `json:"error"`
+			ollamaUsage
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return ChatResponse{}, &ResponseError{Err: fmt.Errorf("parse chat response %q: %w", scanner.Text(), err)}
+		}
+		if chunk.Error != "" {
+			return ChatResponse{}, &ResponseError{Err: fmt.Errorf("ollama: %s", chunk.Error)}
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			onToken(chunk.Message.Content)
+		}
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...) // Each call comes whole, in one chunk
+		if chunk.Done {
+			usage = chunk.usage()
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ChatResponse{}, &ResponseError{Err: fmt.Errorf("read chat response: %w", err)}
+	}
+	return ChatResponse{Content: content.String(), ToolCalls: toolCalls, Usage: usage}, nil
+}
+
+func (o *OllamaBackend) Generate(ctx context.Context, model, prompt string) (string, Usage, error) {
+	payload := map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/api/generate", "", payload)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer resp.Body.Close()
+
+	// Ollama streams one JSON object per line, each carrying a piece of the response
+	scanner := bufio.NewScanner(resp.Body)
+	var response string
+	var usage Usage
+	for scanner.Scan() {
+		var chunk struct {
+			Response *string `json:"response"`
+			Error    string  `json:"error"`
+			Done     bool    `json:"done"`
+			ollamaUsage
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return "", Usage{}, &ResponseError{Err: fmt.Errorf("parse generate response %q: %w", scanner.Text(), err)}
+		}
+		if chunk.Error != "" {
+			return "", Usage{}, &ResponseError{Err: fmt.Errorf("ollama: %s", chunk.Error)}
+		}
+		if chunk.Response == nil {
+			return "", Usage{}, &ResponseError{Err: fmt.Errorf("unexpected generate response %q", scanner.Text())}
+		}
+		response += *chunk.Response
+		if chunk.Done {
+			usage = chunk.usage()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", Usage{}, &ResponseError{Err: fmt.Errorf("read generate response: %w", err)}
+	}
+	return response, usage, nil
+}
+
+func (o *OllamaBackend) Embed(ctx context.Context, model, text string) ([]float32, error) {
+	payload := map[string]interface{}{
+		"model":  model,
+		"prompt": text,
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/api/embeddings", "", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, &ResponseError{Err: fmt.Errorf("parse embeddings response: %w", err)}
+	}
+	if len(result.Embedding) == 0 {
+		return nil, &ResponseError{Err: fmt.Errorf("empty embedding, is %s an embedding model?", model)}
+	}
+	return result.Embedding, nil
+}
+
+func (o *OllamaBackend) ListModels(ctx context.Context) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(ctx, o.BaseURL+"/api/tags", "", &tags); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
+
+// OpenAIBackend talks to any OpenAI-compatible server (llama.cpp server, vLLM, LocalAI).
+// BaseURL includes the version prefix, e.g. http://localhost:8080/v1
+type OpenAIBackend struct {
+	BaseURL string
+	APIKey  string
+}
+
+// openAIToolCall is a ToolCall in the OpenAI format, where the arguments are a JSON string.
+// When streaming, a call arrives in pieces with the same Index.
+type openAIToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// openAIMessage is an answer in the OpenAI format
+type openAIMessage struct {
+	Content   string           `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls"`
+}
+
+// openAIUsage are the token counts of an OpenAI response; when streaming, in the last chunk
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// openAIToolCalls converts calls to ToolCalls, giving an ID to those that have none
+func openAIToolCalls(calls []openAIToolCall) ([]ToolCall, error) {
+	var out []ToolCall
+	for i, call := range calls {
+		var tc ToolCall
+		tc.ID = call.ID
+		if tc.ID == "" {
+			tc.ID = fmt.Sprintf("call_%d", i)
+		}
+		tc.Function.Name = call.Function.Name
+		if strings.TrimSpace(call.Function.Arguments) != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &tc.Function.Arguments); err != nil {
+				return nil, &ResponseError{Err: fmt.Errorf("parse arguments of %s: %w", call.Function.Name, err)}
+			}
+		}
+		out = append(out, tc)
+	}
+	return out, nil
+}
+
+// openAIMessages converts messages to the OpenAI format, where images are content parts with a data URL
+func openAIMessages(messages []ChatMessage) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, msg := range messages {
+		switch {
+		case len(msg.ToolCalls) > 0:
+			var calls []map[string]interface{}
+			for _, call := range msg.ToolCalls {
+				args, _ := json.Marshal(call.Function.Arguments)
+				calls = append(calls, map[string]interface{}{
+					"id":       call.ID,
+					"type":     "function",
+					"function": map[string]string{"name": call.Function.Name, "arguments": string(args)},
+				})
+			}
+			out = append(out, map[string]interface{}{"role": msg.Role, "content": msg.Content, "tool_calls": calls})
+			continue
+		case msg.Role == "tool":
+			out = append(out, map[string]interface{}{"role": msg.Role, "content": msg.Content, "tool_call_id": msg.ToolCallID})
+			continue
+		case len(msg.Images) == 0:
+			out = append(out, map[string]interface{}{"role": msg.Role, "content": msg.Content})
+			continue
+		}
+		parts := []map[string]interface{}{{"type": "text", "text": msg.Content}}
+		for _, img := range msg.Images {
+			url := "data:" + http.DetectContentType(img) + ";base64," + base64.StdEncoding.EncodeToString(img)
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": url}})
+		}
+		out = append(out, map[string]interface{}{"role": msg.Role, "content": parts})
+	}
+	return out
+}
+
+func (o *OpenAIBackend) Chat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": openAIMessages(req.Messages),
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = toolsPayload(req.Tools)
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/chat/completions", o.APIKey, payload)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Choices []struct {
+			Message openAIMessage `json:"message"`
+		} `json:"choices"`
+		Usage openAIUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ChatResponse{}, &ResponseError{Err: fmt.Errorf("parse chat response: %w", err)}
+	}
+	if len(result.Choices) == 0 {
+		return ChatResponse{}, &ResponseError{Err: errors.New("chat response has no choices")}
+	}
+	toolCalls, err := openAIToolCalls(result.Choices[0].Message.ToolCalls)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	return ChatResponse{
+		Content:   result.Choices[0].Message.Content,
+		ToolCalls: toolCalls,
+		Usage:     Usage(result.Usage),
+	}, nil
+}
+
+func (o *OpenAIBackend) ChatStream(ctx context.Context, req ChatRequest, onToken func(token string)) (ChatResponse, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": openAIMessages(req.Messages),
+		"stream":   true,
+		// Token counts in the last chunk
+		"stream_options": map[string]bool{"include_usage": true},
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = toolsPayload(req.Tools)
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/chat/completions", o.APIKey, payload)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	// Server-sent events: "data: {json}" lines, terminated by "data: [DONE]"
+	scanner := bufio.NewScanner(resp.Body)
+	var content strings.Builder
+	var calls []openAIToolCall
+	var usage openAIUsage
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta openAIMessage `json:"delta"`
+			} `json:"choices"`
+			Usage *openAIUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return ChatResponse{}, &ResponseError{Err: fmt.Errorf("parse chat response %q: %w", data, err)}
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			onToken(delta.Content)
+		}
+		// The first piece of a call has its ID and name, the next ones more of its arguments
+		for _, piece := range delta.ToolCalls {
+			for len(calls) <= piece.Index {
+				calls = append(calls, openAIToolCall{Index: len(calls)})
+			}
+			call := &calls[piece.Index]
+			if piece.ID != "" {
+				call.ID = piece.ID
+			}
+			call.Function.Name += piece.Function.Name
+			call.Function.Arguments += piece.Function.Arguments
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ChatResponse{}, &ResponseError{Err: fmt.Errorf("read chat response: %w", err)}
+	}
+	toolCalls, err := openAIToolCalls(calls)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	return ChatResponse{Content: content.String(), ToolCalls: toolCalls, Usage: Usage(usage)}, nil
+}
+
+// Generate is a single-turn chat: not every OpenAI-compatible server implements /completions
+func (o *OpenAIBackend) Generate(ctx context.Context, model, prompt string) (string, Usage, error) {
+	resp, err := o.Chat(ctx, ChatRequest{
+		Model:    model,
+		Messages: []ChatMessage{{Role: "user", Content: prompt}},
+	})
+	return resp.Content, resp.Usage, err
+}
+
+func (o *OpenAIBackend) Embed(ctx context.Context, model, text string) ([]float32, error) {
+	payload := map[string]interface{}{
+		"model": model,
+		"input": text,
+	}
+	resp, err := postJSON(ctx, o.BaseURL+"/embeddings", o.APIKey, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, &ResponseError{Err: fmt.Errorf("parse embeddings response: %w", err)}
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, &ResponseError{Err: errors.New("embeddings response has no embedding")}
+	}
+	return result.Data[0].Embedding, nil
+}
+
+func (o *OpenAIBackend) ListModels(ctx context.Context) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, o.BaseURL+"/models", o.APIKey, &list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range list.Data {
+		names = append(names, m.ID)
+	}
+	return names, nil
+}
@@ -4,8 +4,8 @@ export GOOS=linux; \
 export GOARCH=arm; \
 export GOARM=7; \
 export CC=arm-linux-gnueabi-gcc; \
-CGO_ENABLED=1 go build -ldflags "-linkmode external -extldflags -static" --trimpath  whatsapp_bot.go
+CGO_ENABLED=1 go build -ldflags "-linkmode external -extldflags -static" --trimpath -o whatsapp_bot .
 mv whatsapp_bot build/
-cp install_chatbot.sh ./build
+cp install_chatbot.sh config.example.yaml ./build
 cd build
 tar -czvf ../RPI-chatbot.tar.gz *
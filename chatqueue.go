@@ -0,0 +1,78 @@
+package main
+
+import "sync"
+
+// ChatQueue runs jobs one at a time per chat, in the order they were queued.
+// Different chats still run in parallel.
+type ChatQueue struct {
+	mu     sync.Mutex
+	queues map[string][]func() // a key is present while its worker is running
+}
+
+func NewChatQueue() *ChatQueue {
+	return &ChatQueue{queues: make(map[string][]func())}
+}
+
+// Run queues job behind the pending jobs of key
+func (q *ChatQueue) Run(key string, job func()) {
+	q.mu.Lock()
+	pending, running := q.queues[key]
+	q.queues[key] = append(pending, job)
+	q.mu.Unlock()
+	if !running {
+		go q.work(key)
+	}
+}
+
+func (q *ChatQueue) work(key string) {
+	for {
+		q.mu.Lock()
+		jobs := q.queues[key]
+		if len(jobs) == 0 {
+			delete(q.queues, key)
+			q.mu.Unlock()
+			return
+		}
+		job := jobs[0]
+		q.queues[key] = jobs[1:]
+		q.mu.Unlock()
+		job()
+	}
+}
+
+// KeyedMutex is a set of mutexes created on demand, one per key
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int // goroutines holding or waiting for the lock
+}
+
+// Lock locks key and returns the function that unlocks it
+func (k *KeyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Level is how much a contact is trusted; each command needs a minimum level.
+// Except LevelNone, levels are the roles that can be granted to a contact.
+type Level int
+
+const (
+	LevelBlocked Level = iota // Ignored, even with the password
+	LevelNone                 // Unknown contact: ignored unless the message starts with the password
+	LevelUser                 // Can chat with the AI
+	LevelAdmin                // Can run the system commands and manage users
+	LevelOwner                // The configured number, and whoever it makes owner
+)
+
+var levelNames = map[Level]string{
+	LevelBlocked: "blocked",
+	LevelNone:    "none",
+	LevelUser:    "user",
+	LevelAdmin:   "admin",
+	LevelOwner:   "owner",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+// ParseRole returns the level of a role name that can be granted
+func ParseRole(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if level != LevelNone && strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelNone, fmt.Errorf("unknown role %q, use one of: blocked, user, admin, owner", name)
+}
+
+// CommandContext is what a command gets to know about the message that invoked it
+type CommandContext struct {
+	Account *Account // The number the message was sent to
+	Event   *events.Message
+	Chat    types.JID // Where the reply goes
+	Sender  types.JID // Who sent the command
+	Level   Level     // Trust level of the sender
+	Name    string    // Command name, even if invoked by an alias
+	Args    []string
+	Text    string // Whole message, for prefix routes
+}
+
+// Reply answers in the chat the command came from
+func (c *CommandContext) Reply(text string) {
+	if err := c.Account.SendText(c.Chat, text); err != nil {
+		log.Printf("Failed to reply to %s: %v", c.Chat, err)
+	}
+}
+
+// Command is a word that makes the bot do something instead of answering with the AI
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    string // Argument usage shown in help, e.g. "<number> <role>"
+	Help    string
+	Level   Level
+	MinArgs int
+	MaxArgs int // Messages with more arguments are not this command, they go to the AI
+	Run     func(ctx *CommandContext)
+}
+
+// AnyArgs is the MaxArgs of commands followed by free text
+const AnyArgs = math.MaxInt
+
+// Route handles messages by content rather than by command word,
+// e.g. the conventions of the other bots sharing the owner's chat
+type Route struct {
+	Name  string
+	Level Level
+	Match func(text string) bool
+	Run   func(ctx *CommandContext)
+}
+
+var (
+	commands     = make(map[string]*Command) // By name and alias, lower case
+	commandNames []string                    // Sorted, for help
+	routes       []Route
+)
+
+// RegisterCommand makes cmd available; call it from an init function
+func RegisterCommand(cmd *Command) {
+	for _, word := range append([]string{cmd.Name}, cmd.Aliases...) {
+		word = strings.ToLower(word)
+		if _, exists := commands[word]; exists {
+			panic("command registered twice: " + word)
+		}
+		commands[word] = cmd
+	}
+	commandNames = append(commandNames, cmd.Name)
+	sort.Strings(commandNames)
+}
+
+// RegisterRoute adds a content route; routes are tried in registration order
+func RegisterRoute(route Route) {
+	routes = append(routes, route)
+}
+
+// AddCommandAliases adds the aliases of the configuration file to the registered commands
+func AddCommandAliases(aliases map[string][]string) error {
+	for name, words := range aliases {
+		cmd, ok := commands[strings.ToLower(name)]
+		if !ok || cmd.Name != name {
+			return fmt.Errorf("alias for unknown command %q", name)
+		}
+		for _, word := range words {
+			word = strings.ToLower(word)
+			if other, exists := commands[word]; exists && other != cmd {
+				return fmt.Errorf("alias %q of %s is already the command %s", word, name, other.Name)
+			}
+			commands[word] = cmd
+			cmd.Aliases = append(cmd.Aliases, word)
+		}
+	}
+	return nil
+}
+
+// parseArgs splits text into words; double quotes group words into one argument
+func parseArgs(text string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inWord := false, false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inWord = true
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n'):
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// DispatchCommand runs the command or route matching text, if any, and reports
+// whether it did. Messages it leaves alone are meant for the AI.
+func DispatchCommand(ctx *CommandContext, text string) bool {
+	ctx.Text = text
+	args := parseArgs(text)
+	if len(args) > 0 {
+		if cmd, ok := commands[strings.ToLower(args[0])]; ok && len(args)-1 <= cmd.MaxArgs && ctx.Account.Allows(cmd.Name) {
+			if ctx.Level <= LevelNone && ctx.Level < cmd.Level {
+				// Unknown contacts must not even learn which commands exist
+				return false
+			}
+			ctx.Name = cmd.Name
+			ctx.Args = args[1:]
+			switch {
+			case ctx.Level < cmd.Level:
+				log.Printf("%s (%s) is not allowed to run %s", ctx.Chat, ctx.Level, cmd.Name)
+				ctx.Reply("You are not allowed to use " + cmd.Name + ".")
+			case len(ctx.Args) < cmd.MinArgs:
+				ctx.Reply("Usage: " + cmd.Usage())
+			default:
+				log.Printf("Command %s from %s", cmd.Name, ctx.Chat)
+				cmd.Run(ctx)
+			}
+			return true
+		}
+	}
+	for _, route := range routes {
+		if ctx.Level >= route.Level && ctx.Account.Allows(route.Name) && route.Match(text) {
+			ctx.Name = route.Name
+			route.Run(ctx)
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is the command word followed by its arguments
+func (cmd *Command) Usage() string {
+	if cmd.Args == "" {
+		return cmd.Name
+	}
+	return cmd.Name + " " + cmd.Args
+}
+
+// HelpText lists the commands of account available at level
+func HelpText(account *Account, level Level) string {
+	var sb strings.Builder
+	sb.WriteString("Hi, I'm an AI assistant! Ask me anything.\n\nCommands:")
+	for _, name := range commandNames {
+		cmd := commands[name]
+		if level < cmd.Level || !account.Allows(cmd.Name) {
+			continue
+		}
+		sb.WriteString("\n*" + cmd.Usage() + "* - " + cmd.Help)
+		if len(cmd.Aliases) > 0 {
+			sb.WriteString(" (also: " + strings.Join(cmd.Aliases, ", ") + ")")
+		}
+	}
+	return sb.String()
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "help",
+		Args:    "[command]",
+		Help:    "show this help, or how to use a command",
+		Level:   LevelUser,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			if len(ctx.Args) == 0 {
+				ctx.Reply(HelpText(ctx.Account, ctx.Level))
+				return
+			}
+			cmd, ok := commands[strings.ToLower(ctx.Args[0])]
+			if !ok || ctx.Level < cmd.Level || !ctx.Account.Allows(cmd.Name) {
+				ctx.Reply("Unknown command " + ctx.Args[0] + ", send help for the list.")
+				return
+			}
+			ctx.Reply("*" + cmd.Usage() + "*\n" + cmd.Help)
+		},
+	})
+}
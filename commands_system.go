@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// Commands that act on the Raspberry itself
+
+// publicIPInfo asks ipinfo.io for the public IP and where it is
+func publicIPInfo() string {
+	cmd := exec.Command("curl", "--silent", "--max-time", "10", "ipinfo.io")
+	output, _ := cmd.CombinedOutput()
+	return string(output)
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "ip",
+		Help:  "network interfaces and public IP",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			ctx.Reply(IpConf())
+			ctx.Reply(publicIPInfo())
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "models",
+		Help:  "models available on the AI backend",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			reply := "Current model: " + ctx.Account.PersonaOf(ctx.Chat).Model
+			if models, err := backend.ListModels(context.Background()); err != nil {
+				reply += "\nCannot list models: " + err.Error()
+			} else {
+				reply += "\nAvailable: " + strings.Join(models, ", ")
+			}
+			ctx.Reply(reply)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "reboot",
+		Help:  "reboot the system",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			ctx.Reply("Rebooting the system... please wait.")
+			cmd := exec.Command("reboot")
+			cmd.Run()
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"help", []string{"help"}},
+		{"grant  123\tadmin\n", []string{"grant", "123", "admin"}},
+		{`remind "buy milk" tomorrow`, []string{"remind", "buy milk", "tomorrow"}},
+		{`say "" now`, []string{"say", "", "now"}},
+		{`a"b c"d e`, []string{"ab cd", "e"}},
+		{`open "quote`, []string{"open", "quote"}},
+		{"café ünïcode", []string{"café", "ünïcode"}},
+	}
+	for _, tt := range tests {
+		if got := parseArgs(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseArgs(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// ran lists the test commands run by DispatchCommand
+var ran []string
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "testone",
+		Level:   LevelUser,
+		MaxArgs: 1,
+		Run:     func(ctx *CommandContext) { ran = append(ran, ctx.Name) },
+	})
+	RegisterCommand(&Command{
+		Name:    "testany",
+		Level:   LevelUser,
+		MaxArgs: AnyArgs,
+		Run:     func(ctx *CommandContext) { ran = append(ran, ctx.Name) },
+	})
+}
+
+func TestDispatchCommandMaxArgs(t *testing.T) {
+	// Only the test commands: no route or other command can take the messages
+	account := &Account{AccountConfig: AccountConfig{Commands: []string{"testone", "testany"}}}
+
+	tests := []struct {
+		text  string
+		level Level
+		want  bool
+	}{
+		{"testone", LevelUser, true},
+		{"TESTONE arg", LevelUser, true},
+		{`testone "two words"`, LevelUser, true},
+		{"testone two words", LevelUser, false},
+		{"testany", LevelUser, true},
+		{"testany is followed by any text at all", LevelUser, true},
+		{"testone", LevelNone, false},
+		{"help", LevelOwner, false},
+		{"what is testone", LevelUser, false},
+	}
+	for _, tt := range tests {
+		ran = nil
+		ctx := &CommandContext{Account: account, Level: tt.level}
+		if got := DispatchCommand(ctx, tt.text); got != tt.want {
+			t.Errorf("DispatchCommand(%q) as %s = %v, want %v", tt.text, tt.level, got, tt.want)
+		}
+		if tt.want != (len(ran) == 1) {
+			t.Errorf("DispatchCommand(%q) as %s ran %v", tt.text, tt.level, ran)
+		}
+	}
+}
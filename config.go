@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the bot can be told through its YAML configuration file
+type Config struct {
+	Number   string `yaml:"number"`   // Owner's WhatsApp number without +
+	Password string `yaml:"password"` // Prefix that lets any contact chat with the bot; prefer invite codes
+	Model    string `yaml:"model"`
+	// Model for conversations that contain images; "" sends them to Model
+	VisionModel string `yaml:"vision_model"`
+
+	Backend struct {
+		Type   string `yaml:"type"` // ollama or openai
+		URL    string `yaml:"url"`
+		APIKey string `yaml:"api_key"`
+	} `yaml:"backend"`
+
+	AccountsDB     string        `yaml:"accounts_db"`     // whatsmeow session
+	Database       string        `yaml:"database"`        // Bot state: conversations
+	HistoryTimeout time.Duration `yaml:"history_timeout"` // Inactivity before a conversation is forgotten
+	InviteTTL      time.Duration `yaml:"invite_ttl"`      // Default validity of invite codes
+
+	// Extra words that run each command, by command name, e.g. reboot: [riavvia]
+	Commands map[string][]string `yaml:"commands"`
+
+	SpeechToText SpeechToTextConfig `yaml:"speech_to_text"`
+	TextToSpeech TextToSpeechConfig `yaml:"text_to_speech"`
+
+	Documents struct {
+		MaxSizeMB    int `yaml:"max_size_mb"`   // Bigger files are refused
+		ContextChars int `yaml:"context_chars"` // Document text given to the model with each question
+	} `yaml:"documents"`
+
+	// Folder of documents the bot answers from, searched by embedding similarity
+	Knowledge struct {
+		Dir             string        `yaml:"dir"` // "" disables the knowledge base
+		EmbeddingModel  string        `yaml:"embedding_model"`
+		TopK            int           `yaml:"top_k"`            // Excerpts given to the model with each question
+		MinScore        float64       `yaml:"min_score"`        // Cosine similarity below which an excerpt is left out
+		ReindexInterval time.Duration `yaml:"reindex_interval"` // How often the folder is checked for changes
+	} `yaml:"knowledge"`
+
+	// Functions the model can call while answering, e.g. disk usage or temperatures
+	Tools struct {
+		Enabled   bool `yaml:"enabled"`    // Models that do not support tools are asked without them
+		MaxRounds int  `yaml:"max_rounds"` // Rounds of tool calls before the model must answer
+	} `yaml:"tools"`
+
+	Groups struct {
+		Enabled bool `yaml:"enabled"` // Answer in groups where no admin turned the bot on or off
+	} `yaml:"groups"`
+
+	// Characters the bot answers as, by name; persona is the default, chat_personas
+	// the persona of some chats (numbers or JIDs) until they choose another
+	Persona      string             `yaml:"persona"`
+	Personas     map[string]Persona `yaml:"personas"`
+	ChatPersonas map[string]string  `yaml:"chat_personas"`
+
+	// WhatsApp numbers served by the bot; empty serves one number with the settings above
+	Accounts []AccountConfig `yaml:"accounts"`
+
+	// How a new WhatsApp session is linked; the QR code is printed on the terminal unless a pairing code is shown
+	Pairing struct {
+		Phone string `yaml:"phone"` // The bot's own number without +: link with an 8-character code instead
+		Web   bool   `yaml:"web"`   // Show the QR code and the pairing code on /pair of the HTTP server
+	} `yaml:"pairing"`
+
+	MQTT MQTTConfig `yaml:"mqtt"`
+
+	// Local HTTP server for the other programs on the Pi
+	HTTP struct {
+		Listen string `yaml:"listen"` // e.g. 127.0.0.1:8088; "" disables the server
+		Token  string `yaml:"token"`  // Bearer token of the API (/send, /generate, /chat); "" disables the API
+	} `yaml:"http"`
+
+	// Conventions used by the other bots sharing the owner's chat
+	Routing struct {
+		Ignore           []string `yaml:"ignore"`            // Whole messages meant for another bot
+		IgnorePrefixes   []string `yaml:"ignore_prefixes"`   // Alarms from another bot
+		GeneratePrefixes []string `yaml:"generate_prefixes"` // Single generation tasks, no chat history
+	} `yaml:"routing"`
+}
+
+// SpeechToTextConfig selects how voice notes are transcribed
+type SpeechToTextConfig struct {
+	Engine         string `yaml:"engine"`          // whisper-cpp, http, or "" to ignore voice notes
+	Binary         string `yaml:"binary"`          // whisper-cpp: the whisper.cpp command line tool
+	Model          string `yaml:"model"`           // whisper-cpp: ggml model file; http: model name, if the server wants one
+	URL            string `yaml:"url"`             // http: transcription endpoint
+	Language       string `yaml:"language"`        // e.g. it, en or auto
+	EchoTranscript bool   `yaml:"echo_transcript"` // Send the transcript back before the answer
+}
+
+// TextToSpeechConfig selects how voice replies are synthesized
+type TextToSpeechConfig struct {
+	Engine string `yaml:"engine"` // piper, http, openai, or "" to disable voice replies
+	Binary string `yaml:"binary"` // piper: the piper command line tool
+	Model  string `yaml:"model"`  // piper: .onnx voice file; openai: model name
+	URL    string `yaml:"url"`    // http: piper http_server; openai: /v1/audio/speech endpoint
+	Voice  string `yaml:"voice"`  // openai: voice name
+}
+
+// DefaultConfig is the behaviour of the bot without any configuration file
+func DefaultConfig() Config {
+	var c Config
+	c.Model = "llama3"
+	c.VisionModel = "llava"
+	c.Backend.Type = "ollama"
+	c.AccountsDB = "accounts.db"
+	c.Database = "chatbot.db"
+	c.HistoryTimeout = time.Hour
+	c.InviteTTL = 7 * 24 * time.Hour
+	c.SpeechToText.Binary = "whisper-cli"
+	c.SpeechToText.Language = "auto"
+	c.TextToSpeech.Binary = "piper"
+	c.Documents.MaxSizeMB = 20
+	c.Documents.ContextChars = 12000
+	c.Knowledge.EmbeddingModel = "nomic-embed-text"
+	c.Knowledge.TopK = 4
+	c.Knowledge.MinScore = 0.5
+	c.Knowledge.ReindexInterval = 10 * time.Minute
+	c.MQTT.ClientID = "whatsapp-bot"
+	c.Tools.Enabled = true
+	c.Tools.MaxRounds = 5
+	c.Routing.Ignore = []string{"status"}
+	c.Routing.IgnorePrefixes = []string{"LIVELLO"}
+	c.Routing.GeneratePrefixes = []string{"TITLE:"}
+	return c
+}
+
+// LoadConfig reads path over the defaults. An empty path means defaults only.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, fmt.Errorf("config file %s does not exist", path)
+	} else if err != nil {
+		return c, err
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if c.HistoryTimeout <= 0 {
+		return c, fmt.Errorf("%s: history_timeout must be positive", path)
+	}
+	if c.Documents.MaxSizeMB <= 0 || c.Documents.ContextChars < chunkSize {
+		return c, fmt.Errorf("%s: documents.max_size_mb must be positive and documents.context_chars at least %d", path, chunkSize)
+	}
+	if c.Knowledge.Dir != "" && (c.Knowledge.TopK <= 0 || c.Knowledge.ReindexInterval <= 0 || c.Knowledge.EmbeddingModel == "") {
+		return c, fmt.Errorf("%s: knowledge needs an embedding_model, a positive top_k and a positive reindex_interval", path)
+	}
+	if c.Tools.MaxRounds <= 0 {
+		return c, fmt.Errorf("%s: tools.max_rounds must be positive", path)
+	}
+	if c.InviteTTL <= 0 {
+		return c, fmt.Errorf("%s: invite_ttl must be positive", path)
+	}
+	for name, p := range c.Personas {
+		if name != strings.ToLower(name) || strings.ContainsAny(name, " \t\n") || name == "default" {
+			return c, fmt.Errorf("%s: personas.%s: the name must be a lowercase word other than default", path, name)
+		}
+		if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+			return c, fmt.Errorf("%s: personas.%s: temperature must be between 0 and 2", path, name)
+		}
+	}
+	if _, ok := c.Personas[c.Persona]; c.Persona != "" && !ok {
+		return c, fmt.Errorf("%s: persona: no persona %s in personas", path, c.Persona)
+	}
+	chatPersonas := make(map[string]string)
+	for chat, name := range c.ChatPersonas {
+		jid, err := ParseContact(chat)
+		if err != nil {
+			return c, fmt.Errorf("%s: chat_personas: %w", path, err)
+		}
+		if _, ok := c.Personas[name]; !ok {
+			return c, fmt.Errorf("%s: chat_personas.%s: no persona %s in personas", path, chat, name)
+		}
+		chatPersonas[jid.ToNonAD().String()] = name
+	}
+	c.ChatPersonas = chatPersonas
+	names := make(map[string]bool)
+	for i, account := range c.Accounts {
+		if account.Name == "" || names[strings.ToLower(account.Name)] {
+			return c, fmt.Errorf("%s: accounts[%d] needs a name of its own", path, i)
+		}
+		names[strings.ToLower(account.Name)] = true
+		if account.Phone == "" && len(c.Accounts) > 1 {
+			return c, fmt.Errorf("%s: accounts.%s: phone is required with more than one account", path, account.Name)
+		}
+		if _, ok := c.Personas[account.Persona]; account.Persona != "" && !ok {
+			return c, fmt.Errorf("%s: accounts.%s: no persona %s in personas", path, account.Name, account.Persona)
+		}
+	}
+	for name, words := range c.Commands {
+		for _, word := range words {
+			if strings.TrimSpace(word) == "" || strings.ContainsAny(word, " \t\n") {
+				return c, fmt.Errorf("%s: commands.%s: %q is not a single word", path, name, word)
+			}
+		}
+	}
+	return c, nil
+}
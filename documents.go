@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+// Documents sent in a chat are extracted to text, split in chunks and attached
+// to that chat's context until the conversation expires
+
+const documentsSchema = `
+CREATE TABLE IF NOT EXISTS chat_documents (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	jid        TEXT NOT NULL REFERENCES chats(jid) ON DELETE CASCADE,
+	name       TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS document_chunks (
+	document_id INTEGER NOT NULL REFERENCES chat_documents(id) ON DELETE CASCADE,
+	position    INTEGER NOT NULL,
+	text        TEXT NOT NULL,
+	PRIMARY KEY (document_id, position)
+);
+`
+
+const (
+	chunkSize      = 2000 // Characters per chunk, small enough for one GenerateAI call on a Pi
+	chunkOverlap   = 200  // Characters repeated between chunks, so sentences are not cut in half
+	extractTimeout = 2 * time.Minute
+)
+
+// Document is a file attached to a chat, as chunks of text
+type Document struct {
+	ID     int64
+	Name   string
+	Chunks []string
+}
+
+// Length is the number of characters of the document
+func (d Document) Length() int {
+	n := 0
+	for i, chunk := range d.Chunks {
+		n += len(chunk)
+		if i > 0 {
+			n -= chunkOverlap
+		}
+	}
+	return n
+}
+
+// DocumentStore keeps the documents of every chat
+type DocumentStore struct {
+	db *sql.DB
+}
+
+var documents *DocumentStore
+
+func NewDocumentStore(db *sql.DB) (*DocumentStore, error) {
+	if _, err := db.Exec(documentsSchema); err != nil {
+		return nil, fmt.Errorf("create document tables: %w", err)
+	}
+	return &DocumentStore{db: db}, nil
+}
+
+// Add attaches a document to the conversation jid
+func (s *DocumentStore) Add(jid, name string, chunks []string) (Document, error) {
+	// The conversation must exist: its documents expire with it. A turn in
+	// progress must not see the conversation between Touch and the insert.
+	unlock := history.LockChat(jid)
+	defer unlock()
+	if err := history.Touch(jid); err != nil {
+		return Document{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Document{}, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO chat_documents (jid, name, created_at) VALUES (?, ?, ?)`, jid, name, time.Now().Unix())
+	if err != nil {
+		return Document{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Document{}, err
+	}
+	for i, chunk := range chunks {
+		if _, err := tx.Exec(`INSERT INTO document_chunks (document_id, position, text) VALUES (?, ?, ?)`, id, i, chunk); err != nil {
+			return Document{}, err
+		}
+	}
+	return Document{ID: id, Name: name, Chunks: chunks}, tx.Commit()
+}
+
+// List returns the documents of jid, oldest first
+func (s *DocumentStore) List(jid string) ([]Document, error) {
+	rows, err := s.db.Query(`
+		SELECT d.id, d.name, c.text FROM chat_documents d
+		JOIN document_chunks c ON c.document_id = d.id
+		WHERE d.jid = ?
+		ORDER BY d.id, c.position`, jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var docs []Document
+	for rows.Next() {
+		var id int64
+		var name, text string
+		if err := rows.Scan(&id, &name, &text); err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 || docs[len(docs)-1].ID != id {
+			docs = append(docs, Document{ID: id, Name: name})
+		}
+		docs[len(docs)-1].Chunks = append(docs[len(docs)-1].Chunks, text)
+	}
+	return docs, rows.Err()
+}
+
+// documentMessage returns the document attached to msg, with or without caption
+func documentMessage(msg *waE2E.Message) *waE2E.DocumentMessage {
+	if doc := msg.GetDocumentMessage(); doc != nil {
+		return doc
+	}
+	return msg.GetDocumentWithCaptionMessage().GetMessage().GetDocumentMessage()
+}
+
+// extractText returns the text of a document, depending on its type
+func extractText(name, mimetype string, data []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case ext == ".pdf" || mimetype == "application/pdf":
+		return pdfToText(data)
+	case ext == ".txt", ext == ".md", ext == ".csv", strings.HasPrefix(mimetype, "text/"):
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("%s is not UTF-8 text", name)
+		}
+		return strings.TrimPrefix(string(data), "\uFEFF"), nil
+	}
+	return "", fmt.Errorf("unsupported document type %q (%s)", ext, mimetype)
+}
+
+// pdfToText runs pdftotext from poppler-utils
+func pdfToText(data []byte) (string, error) {
+	file, err := os.CreateTemp("", "document-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return "", err
+	}
+	file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), extractTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "pdftotext", "-layout", "-enc", "UTF-8", file.Name(), "-")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("pdftotext: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// chunkText splits text in chunks of about size characters, cutting at
+// paragraph or line ends when possible, each repeating the end of the previous one
+func chunkText(text string, size, overlap int) []string {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	var chunks []string
+	for len(text) > size {
+		cut := strings.LastIndex(text[:size], "\n\n")
+		if cut < size/2 {
+			cut = strings.LastIndex(text[:size], "\n")
+		}
+		if cut < size/2 {
+			cut = strings.LastIndex(text[:size], " ")
+		}
+		if cut < size/2 {
+			cut = size
+		}
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		chunks = append(chunks, strings.TrimSpace(text[:cut]))
+		next := cut - overlap
+		if next <= 0 {
+			next = cut
+		}
+		for next < len(text) && !utf8.RuneStart(text[next]) {
+			next++
+		}
+		text = text[next:]
+	}
+	if text = strings.TrimSpace(text); text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// words returns the lower case words of text longer than 3 letters, for keyword matching
+func words(text string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len(w) > 3 {
+			set[w] = true
+		}
+	}
+	return set
+}
+
+// documentContext is the system message giving the model the documents of jid:
+// whole if they fit config.Documents.ContextChars, else the chunks sharing most words with prompt
+func documentContext(jid, prompt string) string {
+	docs, err := documents.List(jid)
+	if err != nil {
+		log.Printf("Cannot load the documents of %s: %v", jid, err)
+		return ""
+	}
+	if len(docs) == 0 {
+		return ""
+	}
+
+	type scored struct {
+		doc, pos, score int
+	}
+	var all []scored
+	total := 0
+	query := words(prompt)
+	for d, doc := range docs {
+		for p, chunk := range doc.Chunks {
+			score := 0
+			for w := range words(chunk) {
+				if query[w] {
+					score++
+				}
+			}
+			all = append(all, scored{d, p, score})
+			total += len(chunk)
+		}
+	}
+	if total > config.Documents.ContextChars {
+		sort.SliceStable(all, func(i, j int) bool { return all[i].score > all[j].score })
+		budget, n := config.Documents.ContextChars, 0
+		for n < len(all) && budget >= len(docs[all[n].doc].Chunks[all[n].pos]) {
+			budget -= len(docs[all[n].doc].Chunks[all[n].pos])
+			n++
+		}
+		all = all[:n]
+		// Back in reading order
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].doc < all[j].doc || all[i].doc == all[j].doc && all[i].pos < all[j].pos
+		})
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The user sent these documents. Use them to answer.")
+	lastDoc := -1
+	for _, s := range all {
+		if s.doc != lastDoc {
+			sb.WriteString("\n\n=== " + docs[s.doc].Name + " ===")
+			lastDoc = s.doc
+		} else {
+			sb.WriteString("\n[...]")
+		}
+		sb.WriteString("\n" + docs[s.doc].Chunks[s.pos])
+	}
+	return sb.String()
+}
+
+// summarize reduces chunks to one summary: each chunk is summarized on its own
+// (map), then the summaries are summarized together (reduce), as often as needed
+func summarize(model, name string, chunks []string) (string, error) {
+	for {
+		if len(chunks) == 1 {
+			return GenerateAI(model, "Summarize the following document, "+name+". Keep the key facts and figures.\n\n"+chunks[0])
+		}
+		var partials []string
+		for i, chunk := range chunks {
+			log.Printf("Summarizing %s, part %d/%d", name, i+1, len(chunks))
+			partial, err := GenerateAI(model, fmt.Sprintf("This is part %d of %d of the document %s. Summarize it in a few sentences, keeping the key facts and figures.\n\n%s",
+				i+1, len(chunks), name, chunk))
+			if err != nil {
+				return "", err
+			}
+			partials = append(partials, partial)
+		}
+		// No overlap: the partial summaries are independent paragraphs
+		next := chunkText(strings.Join(partials, "\n\n"), chunkSize, 0)
+		if len(next) >= len(chunks) {
+			// The model does not shorten the parts, another round would not either
+			return strings.Join(partials, "\n\n"), nil
+		}
+		chunks = next
+	}
+}
+
+// ingestDocument reads the document of ctx into the conversation historyJID and
+// reports whether it succeeded. The sender is told what happened.
+func ingestDocument(ctx *CommandContext, historyJID string) bool {
+	doc := documentMessage(ctx.Event.Message)
+	name := doc.GetFileName()
+	if name == "" {
+		name = "document"
+	}
+	if doc.GetFileLength() > uint64(config.Documents.MaxSizeMB)<<20 {
+		ctx.Reply(fmt.Sprintf("%s is too big, I read documents up to %d MB.", name, config.Documents.MaxSizeMB))
+		return false
+	}
+	data, err := ctx.Account.Client().Download(doc)
+	if err != nil {
+		log.Printf("Cannot download %s from %s: %v", name, ctx.Sender, err)
+		ctx.Reply("Sorry, I could not download " + name + ".")
+		return false
+	}
+	text, err := extractText(name, doc.GetMimetype(), data)
+	if err != nil {
+		log.Printf("Cannot read %s from %s: %v", name, ctx.Sender, err)
+		ctx.Reply("Sorry, I cannot read " + name + ". I understand PDF, .txt, .md and .csv files.")
+		return false
+	}
+	chunks := chunkText(text, chunkSize, chunkOverlap)
+	if len(chunks) == 0 {
+		ctx.Reply(name + " contains no text.")
+		return false
+	}
+	stored, err := documents.Add(historyJID, name, chunks)
+	if err != nil {
+		log.Printf("Cannot store %s from %s: %v", name, ctx.Sender, err)
+		ctx.Reply("Sorry, I could not store " + name + ".")
+		return false
+	}
+	log.Printf("Document %s from %s: %d characters in %d chunks", name, ctx.Sender, stored.Length(), len(chunks))
+	if messageText(ctx.Event) == "" {
+		ctx.Reply(fmt.Sprintf("📄 I read %s (%d characters). Ask me about it, or send summarize.", name, stored.Length()))
+	}
+	return true
+}
+
+// historyKey is the conversation a command acts on: the group, or the private chat
+func historyKey(ctx *CommandContext) string {
+	return ctx.Account.HistoryKey(ctx.Chat)
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "summarize",
+		Aliases: []string{"summarise"},
+		Args:    "[document]",
+		Help:    "summarize the last document sent in this chat, or the one named",
+		Level:   LevelUser,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			jid := historyKey(ctx)
+			docs, err := documents.List(jid)
+			if err != nil {
+				log.Printf("Cannot load the documents of %s: %v", jid, err)
+				ctx.Reply("Cannot load your documents, see the log.")
+				return
+			}
+			if len(docs) == 0 {
+				ctx.Reply("Send me a PDF, .txt, .md or .csv file first.")
+				return
+			}
+			doc := docs[len(docs)-1]
+			if len(ctx.Args) > 0 {
+				// "summarize this" means the last one too
+				for _, d := range docs {
+					if strings.EqualFold(d.Name, ctx.Args[0]) || strings.EqualFold(strings.TrimSuffix(d.Name, filepath.Ext(d.Name)), ctx.Args[0]) {
+						doc = d
+					}
+				}
+			}
+
+			reply := ctx.Account.NewStreamReply(ctx.Chat)
+			summary, err := summarize(ctx.Account.PersonaOf(ctx.Chat).Model, doc.Name, doc.Chunks)
+			if err != nil {
+				log.Printf("Cannot summarize %s: %v", doc.Name, err)
+				reply.Finish(aiErrorReply(err))
+				return
+			}
+			reply.Finish(summary)
+
+			// Keep the summary in the conversation for follow-up questions
+			unlock := history.LockChat(jid)
+			defer unlock()
+			err = history.Append(jid, ChatMessage{Role: "user", Content: "Summarize " + doc.Name}, ChatMessage{Role: "assistant", Content: summary})
+			if err != nil {
+				log.Printf("Failed to save chat history for %s: %v", jid, err)
+			}
+		},
+	})
+}
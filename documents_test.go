@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", "  \r\n ", 10, 2, nil},
+		{"fits", " short text \r\n", 20, 5, []string{"short text"}},
+		{"paragraphs", "first part\n\nsecond part", 15, 0, []string{"first part", "second part"}},
+		{"lines", "one two\nthree four", 12, 0, []string{"one two", "three four"}},
+		{"words", "alpha beta gamma delta", 12, 0, []string{"alpha beta", "gamma delta"}},
+		{"no spaces", "abcdefghij", 4, 0, []string{"abcd", "efgh", "ij"}},
+		{"overlap", "abcdefghij", 4, 1, []string{"abcd", "defg", "ghij"}},
+		{"overlap as big as the chunk", "abcdefgh", 4, 4, []string{"abcd", "efgh"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkText(tt.text, tt.size, tt.overlap)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("chunkText(%q, %d, %d) = %q, want %q", tt.text, tt.size, tt.overlap, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkTextKeepsRunes(t *testing.T) {
+	text := strings.Repeat("é", 50)
+	for _, chunk := range chunkText(text, 7, 3) {
+		if !utf8.ValidString(chunk) {
+			t.Fatalf("chunk %q cuts a character in half", chunk)
+		}
+	}
+}
+
+// fakeBackend answers Generate with generate and fails everything else
+type fakeBackend struct {
+	calls    int
+	generate func(prompt string) string
+}
+
+var errFake = errors.New("not implemented by the fake backend")
+
+func (b *fakeBackend) Chat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	return ChatResponse{}, errFake
+}
+
+func (b *fakeBackend) ChatStream(ctx context.Context, req ChatRequest, onToken func(token string)) (ChatResponse, error) {
+	return ChatResponse{}, errFake
+}
+
+func (b *fakeBackend) Generate(ctx context.Context, model, prompt string) (string, Usage, error) {
+	b.calls++
+	return b.generate(prompt), Usage{}, nil
+}
+
+func (b *fakeBackend) Embed(ctx context.Context, model, text string) ([]float32, error) {
+	return nil, errFake
+}
+
+func (b *fakeBackend) ListModels(ctx context.Context) ([]string, error) {
+	return nil, errFake
+}
+
+func TestSummarize(t *testing.T) {
+	saved := backend
+	defer func() { backend = saved }()
+	long := strings.Repeat("word ", chunkSize/5)
+
+	tests := []struct {
+		name     string
+		chunks   int
+		generate func(prompt string) string
+		want     string
+		maxCalls int
+	}{
+		{
+			name:     "one chunk",
+			chunks:   1,
+			generate: func(string) string { return "summary" },
+			want:     "summary",
+			maxCalls: 1,
+		},
+		{
+			name:     "parts then whole",
+			chunks:   4,
+			generate: func(string) string { return "short" },
+			want:     "short",
+			maxCalls: 5,
+		},
+		{
+			// Answers as long as the parts never get down to one chunk:
+			// summarize must give up instead of looping for ever
+			name:     "model does not shorten",
+			chunks:   3,
+			generate: func(string) string { return long },
+			want:     strings.Join([]string{long, long, long}, "\n\n"),
+			maxCalls: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeBackend{generate: tt.generate}
+			backend = fake
+			chunks := make([]string, tt.chunks)
+			for i := range chunks {
+				chunks[i] = "part"
+			}
+			got, err := summarize("model", "doc.txt", chunks)
+			if err != nil {
+				t.Fatalf("summarize: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("summarize = %.60q..., want %.60q...", got, tt.want)
+			}
+			if fake.calls > tt.maxCalls {
+				t.Errorf("summarize called the model %d times, want at most %d", fake.calls, tt.maxCalls)
+			}
+		})
+	}
+}
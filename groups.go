@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// In groups the bot only reacts to messages addressed to it: an @mention, or a
+// reply to one of its messages. Each group has one conversation, with the
+// sender's name in front of every turn.
+
+const groupEnabledSetting = "group.enabled"
+
+// contextInfo returns the mentions and quoted message of msg, if any
+func contextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	if img := msg.GetImageMessage(); img != nil {
+		return img.GetContextInfo()
+	}
+	if audio := msg.GetAudioMessage(); audio != nil {
+		return audio.GetContextInfo()
+	}
+	if doc := documentMessage(msg); doc != nil {
+		return doc.GetContextInfo()
+	}
+	return msg.GetExtendedTextMessage().GetContextInfo()
+}
+
+// addressedToBot reports whether a group message is for the bot, and returns
+// its text without the bot's @mention
+func addressedToBot(account *Account, text string, info *waE2E.ContextInfo) (string, bool) {
+	id := account.Client().Store.ID
+	if id == nil {
+		return text, false
+	}
+	own := id.ToNonAD()
+	mentioned := slices.Contains(info.GetMentionedJID(), own.String())
+	repliedTo := info.GetParticipant() == own.String()
+	if !mentioned && !repliedTo {
+		return text, false
+	}
+	return strings.TrimSpace(strings.ReplaceAll(text, "@"+own.User, "")), true
+}
+
+// groupEnabled reports whether the bot answers the AI in group
+func (a *Account) groupEnabled(group types.JID) bool {
+	return settings.GetBool(group, a.SettingKey(groupEnabledSetting), config.Groups.Enabled)
+}
+
+// LevelIn returns the level of jid writing in chat: members of an enabled group
+// may chat even without a role
+func (a *Account) LevelIn(chat, jid types.JID) Level {
+	level := a.LevelOf(jid)
+	if level == LevelNone && chat.Server == types.GroupServer && a.groupEnabled(chat) {
+		return LevelUser
+	}
+	return level
+}
+
+// HandleGroupMessage is HandleMessage for group chats
+func HandleGroupMessage(account *Account, messageEvent *events.Message, messageContent string) {
+	if messageEvent.Info.IsFromMe {
+		return
+	}
+	prompt, addressed := addressedToBot(account, messageContent, contextInfo(messageEvent.Message))
+	if !addressed || (prompt == "" && !hasMedia(messageEvent)) {
+		return
+	}
+
+	group := messageEvent.Info.Chat
+	sender := messageEvent.Info.Sender.ToNonAD()
+	ctx := &CommandContext{Account: account, Event: messageEvent, Chat: group, Sender: sender, Level: account.LevelIn(group, sender)}
+	if ctx.Level < LevelUser {
+		return
+	}
+	enabled := account.groupEnabled(group)
+
+	if isVoice(messageEvent) {
+		var ok bool
+		if prompt, ok = voiceToText(ctx); !ok {
+			return
+		}
+	}
+
+	if documentMessage(messageEvent.Message) != nil {
+		// The caption, if any, is a question about the document
+		if !enabled || !ingestDocument(ctx, account.HistoryKey(group)) || prompt == "" {
+			return
+		}
+	}
+
+	// Commands work in disabled groups too, so that an admin can turn the bot on
+	if DispatchCommand(ctx, prompt) || !enabled {
+		return
+	}
+	name := messageEvent.Info.PushName
+	if name == "" {
+		name = sender.User
+	}
+	log.Printf("Group request in %s from %s: %s", group, name, prompt)
+	turn, err := userTurn(account, messageEvent, prompt)
+	if err != nil {
+		log.Printf("Cannot read the message of %s in %s: %v", name, group, err)
+		ctx.Reply("Sorry, I could not download your attachment.")
+		return
+	}
+	turn.Content = name + ": " + turn.Content
+	account.ReplyAI(group, account.HistoryKey(group), ctx.Level, turn)
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "group",
+		Args:    "[on|off]",
+		Help:    "turn AI answers on or off in this group",
+		Level:   LevelAdmin,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			if ctx.Chat.Server != types.GroupServer {
+				ctx.Reply("Send this command in a group, mentioning me.")
+				return
+			}
+			if len(ctx.Args) == 0 {
+				if ctx.Account.groupEnabled(ctx.Chat) {
+					ctx.Reply("I answer in this group when mentioned or replied to.")
+				} else {
+					ctx.Reply("I am off in this group. Send group on to turn me on.")
+				}
+				return
+			}
+			var enabled bool
+			switch strings.ToLower(ctx.Args[0]) {
+			case "on":
+				enabled = true
+			case "off":
+				enabled = false
+			default:
+				ctx.Reply("Usage: group [on|off]")
+				return
+			}
+			if err := settings.SetBool(ctx.Chat, ctx.Account.SettingKey(groupEnabledSetting), enabled); err != nil {
+				log.Printf("Cannot save group setting of %s: %v", ctx.Chat, err)
+				ctx.Reply("Cannot save the setting, see the log.")
+				return
+			}
+			if enabled {
+				ctx.Reply("On: mention me or reply to my messages to talk to me.")
+			} else {
+				ctx.Reply("Off: I will not answer in this group anymore.")
+			}
+		},
+	})
+}
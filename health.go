@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Health checks for systemd and monitoring. /healthz tells if the process
+// works, /readyz if it can answer: WhatsApp logged in and the model reachable.
+// Under systemd with WatchdogSec the bot also pings the watchdog while healthy,
+// so a hung bot is restarted.
+
+const (
+	healthTimeout = 5 * time.Second
+	// A disconnection longer than this stops the watchdog pings: whatsmeow
+	// reconnects by itself, a restart is the last resort
+	watchdogDisconnectedGrace = 10 * time.Minute
+)
+
+var (
+	startTime   = time.Now()
+	lastHandled atomic.Int64 // Unix nanoseconds of the last message handled, 0 if none
+	readyOnce   sync.Once
+)
+
+// HealthReport is the answer of /healthz and /readyz
+type HealthReport struct {
+	Status            string          `json:"status"` // "ok" or "fail"
+	Problems          []string        `json:"problems,omitempty"`
+	UptimeSeconds     int64           `json:"uptime_seconds"`
+	WhatsAppConnected bool            `json:"whatsapp_connected"`
+	WhatsAppLoggedIn  bool            `json:"whatsapp_logged_in"`
+	LastMessageAge    *int64          `json:"last_message_age_seconds"` // null if no message was handled since the start
+	BackendReachable  *bool           `json:"backend_reachable,omitempty"`
+	Model             string          `json:"model,omitempty"`
+	ModelAvailable    *bool           `json:"model_available,omitempty"`
+	Accounts          []AccountHealth `json:"accounts"`
+}
+
+// AccountHealth is the WhatsApp state of one account in a HealthReport
+type AccountHealth struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	LoggedIn  bool   `json:"logged_in"`
+	Offline   string `json:"offline,omitempty"` // Why it stays offline on purpose: session replaced or temporary ban
+}
+
+// markHandled records that a message was just handled
+func markHandled() {
+	lastHandled.Store(time.Now().UnixNano())
+}
+
+// healthReport describes the state of the bot; withBackend also asks the AI backend for its models
+func healthReport(ctx context.Context, withBackend bool) HealthReport {
+	report := HealthReport{UptimeSeconds: int64(time.Since(startTime).Seconds())}
+	// The bot is connected when every account is
+	for _, a := range accounts {
+		client := a.Client()
+		report.Accounts = append(report.Accounts, AccountHealth{
+			Name:      a.Name,
+			Connected: client != nil && client.IsConnected(),
+			LoggedIn:  client != nil && client.IsLoggedIn(),
+			Offline:   a.Offline(),
+		})
+	}
+	report.WhatsAppConnected = countAccounts((*whatsmeow.Client).IsConnected) == len(accounts)
+	report.WhatsAppLoggedIn = countAccounts((*whatsmeow.Client).IsLoggedIn) == len(accounts)
+	if last := lastHandled.Load(); last != 0 {
+		age := int64(time.Since(time.Unix(0, last)).Seconds())
+		report.LastMessageAge = &age
+	}
+	if history != nil {
+		if _, err := history.Active(); err != nil {
+			report.Problems = append(report.Problems, "database: "+err.Error())
+		}
+	}
+	if withBackend {
+		for _, a := range report.Accounts {
+			if !a.Connected {
+				report.Problems = append(report.Problems, "WhatsApp "+a.Name+" is not connected")
+			} else if !a.LoggedIn {
+				report.Problems = append(report.Problems, "WhatsApp "+a.Name+" is not logged in")
+			}
+		}
+		report.Model = config.Model
+		reachable, available := false, false
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		models, err := backend.ListModels(ctx)
+		if err != nil {
+			report.Problems = append(report.Problems, "AI backend: "+err.Error())
+		} else {
+			reachable = true
+			available = hasModel(models, config.Model)
+			if !available {
+				report.Problems = append(report.Problems, "model "+config.Model+" is not on the AI backend")
+			}
+			for _, a := range accounts {
+				if a.Model != config.Model && !hasModel(models, a.Model) {
+					report.Problems = append(report.Problems, "model "+a.Model+" of "+a.Name+" is not on the AI backend")
+				}
+			}
+			names := make([]string, 0, len(config.Personas))
+			for name := range config.Personas {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if p := config.Personas[name]; p.Model != "" && !hasModel(models, p.Model) {
+					report.Problems = append(report.Problems, "model "+p.Model+" of persona "+name+" is not on the AI backend")
+				}
+			}
+		}
+		report.BackendReachable, report.ModelAvailable = &reachable, &available
+	}
+	report.Status = "ok"
+	if len(report.Problems) > 0 {
+		report.Status = "fail"
+	}
+	return report
+}
+
+// hasModel reports whether model is in models; Ollama lists "llama3" as "llama3:latest"
+func hasModel(models []string, model string) bool {
+	for _, m := range models {
+		if m == model || m == model+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if len(report.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// sdNotify sends state to systemd, if it started the bot with NOTIFY_SOCKET set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // Abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// notifyReady tells systemd that the bot has started, the first time it is called
+func notifyReady() {
+	readyOnce.Do(func() {
+		if err := sdNotify("READY=1"); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// watchdogInterval returns how often systemd wants to be pinged, 0 if the watchdog is off
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// WatchdogLoop pings the systemd watchdog while the bot is healthy. It returns
+// at once when the watchdog is off.
+func WatchdogLoop() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("systemd watchdog on, pinging every %s", interval)
+	lastConnected := time.Now()
+	for range time.Tick(interval) {
+		// A hung database blocks here and the pings stop
+		report := healthReport(context.Background(), false)
+		// A restart would reconnect the accounts kept offline on purpose: another
+		// instance would lose the session in turn, a banned bot would be banned longer
+		connected := true
+		for _, a := range report.Accounts {
+			connected = connected && (a.Connected || a.Offline != "")
+		}
+		if connected {
+			lastConnected = time.Now()
+		}
+		switch {
+		case len(report.Problems) > 0:
+			log.Printf("Watchdog: not pinging, %s", strings.Join(report.Problems, "; "))
+		case time.Since(lastConnected) > watchdogDisconnectedGrace:
+			log.Printf("Watchdog: not pinging, WhatsApp disconnected for %s", time.Since(lastConnected).Round(time.Second))
+		default:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func init() {
+	httpMux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, healthReport(r.Context(), false))
+	})
+	httpMux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, healthReport(r.Context(), true))
+	})
+}
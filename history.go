@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS chats (
+	jid         TEXT PRIMARY KEY,
+	last_active INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chat_messages (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	jid        TEXT NOT NULL REFERENCES chats(jid) ON DELETE CASCADE,
+	role       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chat_messages_jid ON chat_messages(jid, id);
+CREATE TABLE IF NOT EXISTS chat_images (
+	message_id INTEGER NOT NULL REFERENCES chat_messages(id) ON DELETE CASCADE,
+	position   INTEGER NOT NULL,
+	data       BLOB NOT NULL,
+	PRIMARY KEY (message_id, position)
+);
+`
+
+// HistoryStore keeps the conversation history of every chat in SQLite, so
+// conversations survive restarts. A chat idle for longer than timeout is forgotten.
+// It is safe for concurrent use; LockChat serializes whole turns of a chat.
+type HistoryStore struct {
+	db      *sql.DB
+	timeout time.Duration
+	turns   KeyedMutex
+}
+
+func NewHistoryStore(db *sql.DB, timeout time.Duration) (*HistoryStore, error) {
+	if _, err := db.Exec(historySchema); err != nil {
+		return nil, fmt.Errorf("create history tables: %w", err)
+	}
+	return &HistoryStore{db: db, timeout: timeout}, nil
+}
+
+// LockChat must be held while a turn of jid is in progress, from loading the
+// history to storing the reply, so two turns never interleave. Call the returned function to release it.
+func (h *HistoryStore) LockChat(jid string) func() {
+	return h.turns.Lock(jid)
+}
+
+// History returns the turns of jid in order, or nothing if the chat has expired
+func (h *HistoryStore) History(jid string) ([]ChatMessage, error) {
+	cutoff := time.Now().Add(-h.timeout).Unix()
+	rows, err := h.db.Query(`
+		SELECT m.id, m.role, m.content FROM chat_messages m
+		JOIN chats c ON c.jid = m.jid
+		WHERE m.jid = ? AND c.last_active >= ?
+		ORDER BY m.id`, jid, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []ChatMessage
+	byID := make(map[int64]int) // Message id to index in history
+	for rows.Next() {
+		var id int64
+		var msg ChatMessage
+		if err := rows.Scan(&id, &msg.Role, &msg.Content); err != nil {
+			return nil, err
+		}
+		byID[id] = len(history)
+		history = append(history, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Images stay in the history, so follow-up questions about them work
+	imgRows, err := h.db.Query(`
+		SELECT i.message_id, i.data FROM chat_images i
+		JOIN chat_messages m ON m.id = i.message_id
+		WHERE m.jid = ?
+		ORDER BY i.message_id, i.position`, jid)
+	if err != nil {
+		return nil, err
+	}
+	defer imgRows.Close()
+	for imgRows.Next() {
+		var id int64
+		var data []byte
+		if err := imgRows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[id]; ok {
+			history[i].Images = append(history[i].Images, data)
+		}
+	}
+	return history, imgRows.Err()
+}
+
+// Append adds turns to the history of jid and restarts its inactivity timeout
+func (h *HistoryStore) Append(jid string, msgs ...ChatMessage) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	// An expired chat that was not swept yet must not come back to life
+	if _, err := tx.Exec(`DELETE FROM chats WHERE jid = ? AND last_active < ?`, jid, now-int64(h.timeout.Seconds())); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO chats (jid, last_active) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET last_active = excluded.last_active`, jid, now); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		res, err := tx.Exec(`INSERT INTO chat_messages (jid, role, content, created_at) VALUES (?, ?, ?, ?)`,
+			jid, msg.Role, msg.Content, now)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for i, img := range msg.Images {
+			if _, err := tx.Exec(`INSERT INTO chat_images (message_id, position, data) VALUES (?, ?, ?)`, id, i, img); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Touch creates the conversation jid if needed and restarts its inactivity timeout
+func (h *HistoryStore) Touch(jid string) error {
+	return h.Append(jid)
+}
+
+// Active returns the number of conversations that have not expired
+func (h *HistoryStore) Active() (int, error) {
+	var n int
+	err := h.db.QueryRow(`SELECT COUNT(*) FROM chats WHERE last_active >= ?`, time.Now().Add(-h.timeout).Unix()).Scan(&n)
+	return n, err
+}
+
+// Reset forgets the whole history of jid
+func (h *HistoryStore) Reset(jid string) error {
+	_, err := h.db.Exec(`DELETE FROM chats WHERE jid = ?`, jid)
+	return err
+}
+
+// ExpireLoop deletes chats idle for longer than the timeout, checking every interval
+func (h *HistoryStore) ExpireLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		cutoff := time.Now().Add(-h.timeout).Unix()
+		rows, err := h.db.Query(`SELECT jid FROM chats WHERE last_active < ?`, cutoff)
+		if err != nil {
+			log.Printf("Cannot look for expired chats: %v", err)
+			continue
+		}
+		var expired []string
+		for rows.Next() {
+			var jid string
+			if rows.Scan(&jid) == nil {
+				expired = append(expired, jid)
+			}
+		}
+		rows.Close()
+		for _, jid := range expired {
+			// Check the timeout again: the chat may have been active since the query
+			res, err := h.db.Exec(`DELETE FROM chats WHERE jid = ? AND last_active < ?`, jid, cutoff)
+			if err != nil {
+				log.Printf("Cannot reset chat history for %s: %v", jid, err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("Chat history reset for %s due to inactivity.\n", jid)
+			}
+		}
+	}
+}
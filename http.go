@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The bot offers everything other programs on the Pi need over one local HTTP
+// server; each feature registers its handlers on httpMux from an init function.
+
+var httpMux = http.NewServeMux()
+
+// RunHTTPServer serves httpMux on addr until the process exits
+func RunHTTPServer(addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("HTTP server listening on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("HTTP server stopped: %v", err)
+	}
+}
+
+// writeJSON answers with v as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Cannot write HTTP response: %v", err)
+	}
+}
+
+// writeError answers with {"error": message}
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
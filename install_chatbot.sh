@@ -1,12 +1,31 @@
 #/bin/bash
 read -p "Insert Whatsapp number with country code without + (es: italian number 3334455666 -> 393334455666): " whats_number
+read -p "Insert the bot's own Whatsapp number to pair it with a code, empty to scan a QR code: " bot_number
 sudo apt update
 sudo apt upgrade -y
-sudo apt install curl -y
+sudo apt install curl ffmpeg poppler-utils -y
 curl -fsSL https://ollama.com/install.sh | sh
 mkdir -p /opt/chatbot/
 mv whatsapp_bot /opt/chatbot/
 
+#Create chatbot configuration (see config.example.yaml for every option)
+sudo tee /opt/chatbot/config.yaml <<EOF
+number: "$whats_number"
+# No shared password: the owner sends "invite" to the bot and each contact sends "join <code>"
+password: ""
+model: llama3
+backend:
+  type: ollama
+  url: http://localhost:11434
+accounts_db: /opt/chatbot/accounts.db
+database: /opt/chatbot/chatbot.db
+knowledge:
+  dir: /opt/chatbot/knowledge
+pairing:
+  phone: "$bot_number"
+EOF
+mkdir -p /opt/chatbot/knowledge
+
 #Check ping
 sudo tee /opt/chatbot/check_ping.sh <<EOF
 #!/bin/bash
@@ -28,13 +47,18 @@ After=network.target auditd.service
 ExecStartPre=/usr/bin/sleep 10
 ExecStartPre=/opt/chatbot/check_ping.sh
 WorkingDirectory=/opt/chatbot/
-ExecStart=/opt/chatbot/whatsapp_bot -number $whats_number -password "robot "
+ExecStart=/opt/chatbot/whatsapp_bot -config /opt/chatbot/config.yaml
+Type=notify
+TimeoutStartSec=300
+WatchdogSec=120
 Restart=on-failure
 
 [Install]
 WantedBy=multi-user.target
 EOF
-cd /opt/chatbot
-timeout 120 ./whatsapp_bot
 ollama pull llama3
+ollama pull nomic-embed-text
 sudo systemctl enable --now chatbot
+#Pair: the log shows the pairing code, or the QR code to scan
+#Then give access to contacts: send "invite" to the bot, the contact sends "join <code>"
+journalctl -u chatbot -f
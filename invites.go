@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const invitesSchema = `
+CREATE TABLE IF NOT EXISTS invites (
+	code       TEXT PRIMARY KEY,
+	contact    TEXT NOT NULL DEFAULT '', -- if set, only this contact can use the code
+	created_by TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_by    TEXT NOT NULL DEFAULT '',
+	used_at    INTEGER NOT NULL DEFAULT 0,
+	revoked    INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// Invite codes link a contact to the bot once, giving it the user role, so it
+// can chat without a shared secret in every message
+type InviteStore struct {
+	db *sql.DB
+}
+
+// Invite is a code created by an admin, valid on one account
+type Invite struct {
+	Account   string // Key of the account the contact joins
+	Code      string
+	Contact   types.JID // Empty if anyone can use it
+	CreatedBy types.JID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedBy    types.JID
+	UsedAt    time.Time
+	Revoked   bool
+}
+
+// Status is how the invite is shown by the invites command
+func (inv Invite) Status() string {
+	switch {
+	case inv.Revoked:
+		return "revoked"
+	case !inv.UsedBy.IsEmpty():
+		return "used by " + inv.UsedBy.User + " on " + inv.UsedAt.Format("2006-01-02")
+	case time.Now().After(inv.ExpiresAt):
+		return "expired"
+	}
+	return "valid until " + inv.ExpiresAt.Format("2006-01-02 15:04")
+}
+
+var (
+	invites *InviteStore
+
+	ErrInviteInvalid = errors.New("this invite code is not valid")
+	ErrInviteExpired = errors.New("this invite code has expired")
+)
+
+func NewInviteStore(db *sql.DB) (*InviteStore, error) {
+	if _, err := db.Exec(invitesSchema); err != nil {
+		return nil, fmt.Errorf("create invites table: %w", err)
+	}
+	if err := addColumn(db, "invites", "account", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	return &InviteStore{db: db}, nil
+}
+
+// Letters and digits that cannot be mistaken for each other
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newInviteCode returns a random code such as K7P2-QX9M
+func newInviteCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = inviteAlphabet[int(b)%len(inviteAlphabet)]
+	}
+	return string(buf[:4]) + "-" + string(buf[4:]), nil
+}
+
+// normalizeCode accepts codes typed in lower case or without the dash
+func normalizeCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// Create makes a new invite to account valid for ttl. If contact is not empty, only that contact can use it.
+func (s *InviteStore) Create(account string, contact, by types.JID, ttl time.Duration) (Invite, error) {
+	code, err := newInviteCode()
+	if err != nil {
+		return Invite{}, err
+	}
+	now := time.Now()
+	inv := Invite{Account: account, Code: code, Contact: contact.ToNonAD(), CreatedBy: by.ToNonAD(), CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	contactStr := ""
+	if !inv.Contact.IsEmpty() {
+		contactStr = inv.Contact.String()
+	}
+	_, err = s.db.Exec(`INSERT INTO invites (account, code, contact, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		inv.Account, inv.Code, contactStr, inv.CreatedBy.String(), now.Unix(), inv.ExpiresAt.Unix())
+	return inv, err
+}
+
+// Get returns the invite to account with code
+func (s *InviteStore) Get(account, code string) (Invite, error) {
+	row := s.db.QueryRow(`SELECT account, code, contact, created_by, created_at, expires_at, used_by, used_at, revoked FROM invites
+		WHERE account = ? AND code = ?`, account, normalizeCode(code))
+	inv, err := scanInvite(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return inv, ErrInviteInvalid
+	}
+	return inv, err
+}
+
+// List returns the invites to account created in the last month, newest first
+func (s *InviteStore) List(account string) ([]Invite, error) {
+	rows, err := s.db.Query(`SELECT account, code, contact, created_by, created_at, expires_at, used_by, used_at, revoked FROM invites
+		WHERE account = ? AND created_at >= ? ORDER BY created_at DESC`, account, time.Now().AddDate(0, -1, 0).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, inv)
+	}
+	return list, rows.Err()
+}
+
+func scanInvite(row interface{ Scan(...interface{}) error }) (Invite, error) {
+	var inv Invite
+	var contact, createdBy, usedBy string
+	var createdAt, expiresAt, usedAt int64
+	if err := row.Scan(&inv.Account, &inv.Code, &contact, &createdBy, &createdAt, &expiresAt, &usedBy, &usedAt, &inv.Revoked); err != nil {
+		return inv, err
+	}
+	inv.Contact, _ = types.ParseJID(contact)
+	inv.CreatedBy, _ = types.ParseJID(createdBy)
+	inv.UsedBy, _ = types.ParseJID(usedBy)
+	inv.CreatedAt, inv.ExpiresAt, inv.UsedAt = time.Unix(createdAt, 0), time.Unix(expiresAt, 0), time.Unix(usedAt, 0)
+	return inv, nil
+}
+
+// Redeem links jid with code and gives it the user role on account
+func (s *InviteStore) Redeem(account, code string, jid types.JID) (Invite, error) {
+	jid = jid.ToNonAD()
+	inv, err := s.Get(account, code)
+	if err != nil {
+		return inv, err
+	}
+	switch {
+	case inv.Revoked, !inv.UsedBy.IsEmpty(), !inv.Contact.IsEmpty() && inv.Contact != jid:
+		return inv, ErrInviteInvalid
+	case time.Now().After(inv.ExpiresAt):
+		return inv, ErrInviteExpired
+	}
+	// The condition makes sure two contacts cannot redeem the same code at once
+	res, err := s.db.Exec(`UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by = '' AND revoked = 0`,
+		jid.String(), time.Now().Unix(), inv.Code)
+	if err != nil {
+		return inv, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return inv, ErrInviteInvalid
+	}
+	inv.UsedBy, inv.UsedAt = jid, time.Now()
+	return inv, roles.Grant(account, jid, LevelUser, inv.CreatedBy)
+}
+
+// Revoke invalidates code of account. If it was already used, the contact it linked loses the user role.
+func (s *InviteStore) Revoke(account, code string) (Invite, error) {
+	inv, err := s.Get(account, code)
+	if err != nil {
+		return inv, err
+	}
+	if _, err := s.db.Exec(`UPDATE invites SET revoked = 1 WHERE code = ?`, inv.Code); err != nil {
+		return inv, err
+	}
+	inv.Revoked = true
+	if !inv.UsedBy.IsEmpty() && roles.LevelOf(account, inv.UsedBy) == LevelUser {
+		_, err = roles.Revoke(account, inv.UsedBy)
+	}
+	return inv, err
+}
+
+// parseTTL accepts Go durations ("12h", "90m") and whole days ("7d")
+func parseTTL(arg string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(arg, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("%q is not a number of days", arg)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(arg)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("%q is not a duration, e.g. 12h or 7d", arg)
+	}
+	return ttl, nil
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "invite",
+		Args:    "[number] [duration]",
+		Help:    "create an invite code; the contact links itself by sending join <code>",
+		Level:   LevelAdmin,
+		MaxArgs: 2,
+		Run: func(ctx *CommandContext) {
+			var contact types.JID
+			ttl := config.InviteTTL
+			for _, arg := range ctx.Args {
+				if d, err := parseTTL(arg); err == nil {
+					ttl = d
+				} else if jid, err := ParseContact(arg); err == nil {
+					contact = jid
+				} else {
+					ctx.Reply(fmt.Sprintf("%q is neither a number nor a duration.", arg))
+					return
+				}
+			}
+			inv, err := invites.Create(ctx.Account.Key(), contact, ctx.Sender, ttl)
+			if err != nil {
+				log.Printf("Cannot create invite: %v", err)
+				ctx.Reply("Cannot create the invite, see the log.")
+				return
+			}
+			reply := "Invite code: " + inv.Code + "\nThe contact must send: join " + inv.Code + "\nValid until " + inv.ExpiresAt.Format("2006-01-02 15:04")
+			if !contact.IsEmpty() {
+				reply += ", only for " + contact.User
+			}
+			ctx.Reply(reply)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "invites",
+		Help:  "list the invite codes of the last month",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			list, err := invites.List(ctx.Account.Key())
+			if err != nil {
+				log.Printf("Cannot list invites: %v", err)
+				ctx.Reply("Cannot list invites, see the log.")
+				return
+			}
+			if len(list) == 0 {
+				ctx.Reply("No invites in the last month.")
+				return
+			}
+			var reply []string
+			for _, inv := range list {
+				line := inv.Code + " - " + inv.Status()
+				if !inv.Contact.IsEmpty() {
+					line += " (for " + inv.Contact.User + ")"
+				}
+				reply = append(reply, line)
+			}
+			ctx.Reply(strings.Join(reply, "\n"))
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "uninvite",
+		Args:    "<code>",
+		Help:    "revoke an invite code and the access of the contact that used it",
+		Level:   LevelAdmin,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			inv, err := invites.Revoke(ctx.Account.Key(), ctx.Args[0])
+			if errors.Is(err, ErrInviteInvalid) {
+				ctx.Reply("Unknown invite code.")
+				return
+			} else if err != nil {
+				log.Printf("Cannot revoke invite %s: %v", inv.Code, err)
+				ctx.Reply("Cannot revoke the invite, see the log.")
+				return
+			}
+			reply := "Invite " + inv.Code + " revoked."
+			if !inv.UsedBy.IsEmpty() {
+				reply += " " + inv.UsedBy.User + " can no longer chat with me."
+			}
+			ctx.Reply(reply)
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "join",
+		Args:    "<code>",
+		Help:    "link yourself to the bot with an invite code",
+		Level:   LevelNone,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			if ctx.Level >= LevelUser {
+				ctx.Reply("You can already chat with me.")
+				return
+			}
+			_, err := invites.Redeem(ctx.Account.Key(), ctx.Args[0], ctx.Sender)
+			switch {
+			case errors.Is(err, ErrInviteInvalid):
+				log.Printf("%s tried invite code %s: %v", ctx.Sender, ctx.Args[0], err)
+				ctx.Reply("This invite code is not valid.")
+			case errors.Is(err, ErrInviteExpired):
+				log.Printf("%s tried invite code %s: %v", ctx.Sender, ctx.Args[0], err)
+				ctx.Reply("This invite code has expired, ask for a new one.")
+			case err != nil:
+				log.Printf("Cannot redeem invite for %s: %v", ctx.Sender, err)
+				ctx.Reply("Something went wrong, please try again later.")
+			default:
+				log.Printf("%s joined with invite %s", ctx.Sender, normalizeCode(ctx.Args[0]))
+				ctx.Reply("Welcome! You can now chat with me. Send help for the commands.")
+			}
+		},
+	})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The knowledge base is a folder of documents the bot answers from. Files are
+// split in chunks, embedded by the backend and the vectors kept in SQLite; the
+// chunks closest to a question are given to the model with their file names.
+
+const knowledgeSchema = `
+CREATE TABLE IF NOT EXISTS knowledge_files (
+	path     TEXT PRIMARY KEY,
+	size     INTEGER NOT NULL,
+	mod_time INTEGER NOT NULL,
+	model    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS knowledge_chunks (
+	path      TEXT NOT NULL REFERENCES knowledge_files(path) ON DELETE CASCADE,
+	position  INTEGER NOT NULL,
+	text      TEXT NOT NULL,
+	embedding BLOB NOT NULL,
+	PRIMARY KEY (path, position)
+);
+`
+
+const (
+	knowledgeChunkSize    = 1000 // Smaller than document chunks: one topic per vector finds better matches
+	knowledgeChunkOverlap = 150
+)
+
+// knowledgeExtensions are the files indexed, the ones extractText understands
+var knowledgeExtensions = []string{".pdf", ".txt", ".md", ".csv"}
+
+// KnowledgeChunk is a piece of a file of the knowledge base
+type KnowledgeChunk struct {
+	Path   string // Relative to the knowledge folder
+	Text   string
+	vector []float32 // Normalized, so the dot product is the cosine similarity
+}
+
+// KnowledgeHit is a chunk found by Search, with its similarity to the query
+type KnowledgeHit struct {
+	KnowledgeChunk
+	Score float64
+}
+
+// KnowledgeBase indexes the files of dir with the embedding model. It is safe
+// for concurrent use: Search works on the last complete index while Index runs.
+type KnowledgeBase struct {
+	db    *sql.DB
+	dir   string
+	model string
+
+	indexing sync.Mutex // One Index at a time
+
+	mu     sync.RWMutex
+	chunks []KnowledgeChunk // Every indexed chunk, kept in memory for searching
+}
+
+var knowledge *KnowledgeBase // nil when no knowledge folder is configured
+
+func NewKnowledgeBase(db *sql.DB, dir, model string) (*KnowledgeBase, error) {
+	if _, err := db.Exec(knowledgeSchema); err != nil {
+		return nil, fmt.Errorf("create knowledge tables: %w", err)
+	}
+	k := &KnowledgeBase{db: db, dir: dir, model: model}
+	if err := k.load(); err != nil {
+		return nil, fmt.Errorf("load knowledge base: %w", err)
+	}
+	return k, nil
+}
+
+// load reads the chunks embedded with the current model into memory
+func (k *KnowledgeBase) load() error {
+	rows, err := k.db.Query(`
+		SELECT c.path, c.text, c.embedding FROM knowledge_chunks c
+		JOIN knowledge_files f ON f.path = c.path
+		WHERE f.model = ?
+		ORDER BY c.path, c.position`, k.model)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var chunks []KnowledgeChunk
+	for rows.Next() {
+		var chunk KnowledgeChunk
+		var blob []byte
+		if err := rows.Scan(&chunk.Path, &chunk.Text, &blob); err != nil {
+			return err
+		}
+		chunk.vector = decodeVector(blob)
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.chunks = chunks
+	k.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of files and chunks searched
+func (k *KnowledgeBase) Len() (files, chunks int) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i, chunk := range k.chunks {
+		if i == 0 || chunk.Path != k.chunks[i-1].Path {
+			files++
+		}
+	}
+	return files, len(k.chunks)
+}
+
+// Index brings the index up to date with the folder: new and modified files
+// are embedded again, deleted files are dropped. Unchanged files cost nothing.
+func (k *KnowledgeBase) Index() (updated, removed int, err error) {
+	k.indexing.Lock()
+	defer k.indexing.Unlock()
+
+	type fileState struct {
+		size, modTime int64
+		model         string
+	}
+	known := make(map[string]fileState)
+	rows, err := k.db.Query(`SELECT path, size, mod_time, model FROM knowledge_files`)
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var path string
+		var state fileState
+		if err := rows.Scan(&path, &state.size, &state.modTime, &state.model); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		known[path] = state
+	}
+	rows.Close()
+
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(k.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != k.dir {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !matchesAny(filepath.Ext(path), knowledgeExtensions) {
+			return nil
+		}
+		rel, err := filepath.Rel(k.dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		seen[rel] = true
+		state := fileState{info.Size(), info.ModTime().UnixNano(), k.model}
+		if known[rel] == state {
+			return nil
+		}
+		if err := k.indexFile(rel, state.size, state.modTime); err != nil {
+			return err
+		}
+		updated++
+		return nil
+	})
+
+	for path := range known {
+		if seen[path] || err != nil {
+			continue // Keep everything if the walk stopped early
+		}
+		if _, err := k.db.Exec(`DELETE FROM knowledge_files WHERE path = ?`, path); err != nil {
+			return updated, removed, err
+		}
+		log.Printf("Knowledge base: removed %s", path)
+		removed++
+	}
+	if updated > 0 || removed > 0 {
+		if err := k.load(); err != nil {
+			return updated, removed, err
+		}
+	}
+	return updated, removed, err
+}
+
+// indexFile embeds the chunks of the file rel and replaces what was stored for it.
+// A file that cannot be read is stored without chunks, so it is tried again only once it changes.
+func (k *KnowledgeBase) indexFile(rel string, size, modTime int64) error {
+	var chunks []string
+	var vectors [][]float32
+	data, err := os.ReadFile(filepath.Join(k.dir, rel))
+	if err == nil {
+		var text string
+		if text, err = extractText(rel, "", data); err == nil {
+			chunks = chunkText(text, knowledgeChunkSize, knowledgeChunkOverlap)
+		}
+	}
+	if err != nil {
+		log.Printf("Knowledge base: cannot read %s: %v", rel, err)
+	}
+	for i, chunk := range chunks {
+		// The file name helps matching questions that name it
+		vector, err := embed(rel + "\n" + chunk)
+		if err != nil {
+			return fmt.Errorf("embed %s, part %d/%d: %w", rel, i+1, len(chunks), err)
+		}
+		vectors = append(vectors, vector)
+	}
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM knowledge_files WHERE path = ?`, rel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO knowledge_files (path, size, mod_time, model) VALUES (?, ?, ?, ?)`, rel, size, modTime, k.model); err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		if _, err := tx.Exec(`INSERT INTO knowledge_chunks (path, position, text, embedding) VALUES (?, ?, ?, ?)`,
+			rel, i, chunk, encodeVector(vectors[i])); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Knowledge base: indexed %s in %d chunks", rel, len(chunks))
+	return nil
+}
+
+// IndexLoop indexes the folder now and again every interval
+func (k *KnowledgeBase) IndexLoop(interval time.Duration) {
+	for {
+		if updated, removed, err := k.Index(); err != nil {
+			log.Printf("Knowledge base indexing failed (%d files updated, %d removed): %v", updated, removed, err)
+		} else if updated > 0 || removed > 0 {
+			files, chunks := k.Len()
+			log.Printf("Knowledge base: %d files updated, %d removed, %d files in %d chunks", updated, removed, files, chunks)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Search returns the n chunks most similar to query, scoring at least minScore, best first
+func (k *KnowledgeBase) Search(query string, n int, minScore float64) ([]KnowledgeHit, error) {
+	k.mu.RLock()
+	empty := len(k.chunks) == 0
+	k.mu.RUnlock()
+	if empty {
+		// Nothing to find: spare the backend an embedding for every message
+		return nil, nil
+	}
+	vector, err := embed(query)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var hits []KnowledgeHit
+	for _, chunk := range k.chunks {
+		if len(chunk.vector) != len(vector) {
+			continue
+		}
+		var score float64
+		for i, v := range vector {
+			score += float64(v) * float64(chunk.vector[i])
+		}
+		if score >= minScore {
+			hits = append(hits, KnowledgeHit{chunk, score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	return hits, nil
+}
+
+// embed returns the normalized embedding of text
+func embed(text string) ([]float32, error) {
+	var vector []float32
+	err := withRetries("AI embed", func() (err error) {
+		start := time.Now()
+		vector, err = backend.Embed(context.Background(), config.Knowledge.EmbeddingModel, text)
+		observeAI("embed", start, Usage{}, err)
+		return err
+	})
+	if err != nil {
+		countAIError("embed", err)
+		return nil, err
+	}
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range vector {
+			vector[i] = float32(float64(vector[i]) / norm)
+		}
+	}
+	return vector, nil
+}
+
+func encodeVector(vector []float32) []byte {
+	blob := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(v))
+	}
+	return blob
+}
+
+func decodeVector(blob []byte) []float32 {
+	vector := make([]float32, len(blob)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+	return vector
+}
+
+// knowledgeContext is the system message with the parts of the knowledge base
+// closest to prompt, and the files they come from
+func knowledgeContext(prompt string) (string, []string) {
+	if knowledge == nil || strings.TrimSpace(prompt) == "" {
+		return "", nil
+	}
+	hits, err := knowledge.Search(prompt, config.Knowledge.TopK, config.Knowledge.MinScore)
+	if err != nil {
+		log.Printf("Knowledge base search failed: %v", err)
+		return "", nil
+	}
+	if len(hits) == 0 {
+		return "", nil
+	}
+	var sb strings.Builder
+	sb.WriteString("Excerpts from the knowledge base that may help with the question. " +
+		"Use them when relevant and cite the file name in square brackets, e.g. [" + hits[0].Path + "].")
+	var sources []string
+	for _, hit := range hits {
+		sb.WriteString("\n\n[" + hit.Path + "]\n" + hit.Text)
+		if !matchesAny(hit.Path, sources) {
+			sources = append(sources, hit.Path)
+		}
+	}
+	return sb.String(), sources
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "reindex",
+		Help:  "look for new, changed and deleted files in the knowledge folder",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			if knowledge == nil {
+				ctx.Reply("No knowledge folder is configured.")
+				return
+			}
+			updated, removed, err := knowledge.Index()
+			files, chunks := knowledge.Len()
+			reply := fmt.Sprintf("Knowledge base: %d files updated, %d removed. %d files in %d chunks.", updated, removed, files, chunks)
+			if err != nil {
+				log.Printf("Knowledge base indexing failed: %v", err)
+				reply += "\nIndexing stopped: " + err.Error()
+			}
+			ctx.Reply(reply)
+		},
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Connection lifecycle: whatsmeow reconnects by itself after a network
+// problem, but not after a logout, a ban or another client taking the session.
+// These are logged and told to the owner as soon as the bot can send again.
+
+const (
+	// Disconnections shorter than this are not worth a message to the owner
+	reconnectNoticeAfter = 5 * time.Minute
+	// Time left to whatsmeow to delete the session before pairing again
+	repairDelay = 5 * time.Second
+)
+
+// NotifyOwner sends text to the owner of the account, now if WhatsApp is
+// logged in, otherwise on the next connection
+func (a *Account) NotifyOwner(text string) {
+	if a.Number == "" {
+		return
+	}
+	if client := a.Client(); client == nil || !client.IsLoggedIn() {
+		a.mu.Lock()
+		a.notices = append(a.notices, text)
+		a.mu.Unlock()
+		return
+	}
+	owner := types.NewJID(a.Number, types.DefaultUserServer)
+	if err := a.SendText(owner, text); err != nil {
+		log.Printf("Cannot notify the owner of %s: %v", a.Name, err)
+	}
+}
+
+// handleLifecycleEvent handles the connection events of the account's client
+func (a *Account) handleLifecycleEvent(evt interface{}) {
+	switch v := evt.(type) {
+	case *events.Connected:
+		a.mu.Lock()
+		down := time.Duration(0)
+		if !a.disconnectedAt.IsZero() {
+			down = time.Since(a.disconnectedAt)
+		}
+		a.disconnectedAt = time.Time{}
+		a.offline = ""
+		notices := a.notices
+		a.notices = nil
+		a.mu.Unlock()
+		log.Printf("WhatsApp %s connected", a.Name)
+		notifyReady()
+		if down > reconnectNoticeAfter {
+			notices = append(notices, "🔌 Back online after "+down.Round(time.Second).String()+" without WhatsApp.")
+		}
+		for _, notice := range notices {
+			a.NotifyOwner(notice)
+		}
+
+	case *events.Disconnected:
+		a.mu.Lock()
+		if a.disconnectedAt.IsZero() {
+			a.disconnectedAt = time.Now()
+		}
+		a.mu.Unlock()
+		log.Printf("WhatsApp %s disconnected, reconnecting", a.Name)
+
+	case *events.StreamReplaced:
+		// Another process uses the same session: connecting again would throw it out, and then it would do the same
+		log.Printf("WhatsApp %s session taken by another client with the same keys, is the bot running twice? Not reconnecting", a.Name)
+		a.setOffline("session replaced")
+		a.NotifyOwner("⚠️ Another client connected with this bot's session and the bot went offline. Is it running twice?")
+
+	case *events.TemporaryBan:
+		log.Printf("WhatsApp %s: %s", a.Name, v)
+		a.setOffline("temporary ban")
+		a.NotifyOwner("⛔ " + v.String())
+		if v.Expire > 0 {
+			client := a.Client()
+			time.AfterFunc(v.Expire, func() {
+				log.Printf("WhatsApp %s ban expired, connecting again", a.Name)
+				if err := client.Connect(); err != nil {
+					log.Printf("Cannot connect %s to WhatsApp: %v", a.Name, err)
+				}
+			})
+		}
+
+	case *events.LoggedOut:
+		log.Printf("WhatsApp %s logged out (reason %s), the device was unlinked: pairing again", a.Name, v.Reason)
+		a.NotifyOwner("🔑 The bot was logged out of WhatsApp (" + v.Reason.String() + ") and was paired again.")
+		go a.repair()
+	}
+}
+
+// setOffline records that the account stays offline on purpose until it connects
+// again, so the watchdog does not restart the bot to reconnect it
+func (a *Account) setOffline(reason string) {
+	a.mu.Lock()
+	a.offline = reason
+	a.mu.Unlock()
+}
+
+// Offline returns why the account stays offline on purpose, "" if it does not
+func (a *Account) Offline() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.offline
+}
+
+// repair drops the stale device and pairs a new one, replacing the account's client
+func (a *Account) repair() {
+	time.Sleep(repairDelay)
+	old := a.Client()
+	old.Disconnect()
+	if old.Store.ID != nil {
+		// whatsmeow deletes the session on logout, unless that failed
+		if err := old.Store.Delete(); err != nil {
+			log.Printf("Cannot delete the stale WhatsApp device of %s: %v", a.Name, err)
+		}
+	}
+	if err := a.NewClient(true); err != nil {
+		log.Printf("Cannot create a new WhatsApp client for %s: %v", a.Name, err)
+		return
+	}
+	a.Connect()
+}
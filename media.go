@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media: what the bot does with attachments before they reach the AI, and how it sends its own
+
+const defaultImagePrompt = "Describe this image."
+
+// messageText returns the text of a message: the body of a text message or the caption of an attachment
+func messageText(messageEvent *events.Message) string {
+	msg := messageEvent.Message
+	switch {
+	case msg.Conversation != nil:
+		return msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.GetText()
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.GetCaption()
+	case documentMessage(msg) != nil:
+		return documentMessage(msg).GetCaption()
+	}
+	return ""
+}
+
+// isVoice reports whether the message is a voice note the bot can transcribe
+func isVoice(messageEvent *events.Message) bool {
+	return transcriber != nil && messageEvent.Message.GetAudioMessage() != nil
+}
+
+// hasMedia reports whether the message carries an attachment the bot understands
+func hasMedia(messageEvent *events.Message) bool {
+	return messageEvent.Message.GetImageMessage() != nil || isVoice(messageEvent) || documentMessage(messageEvent.Message) != nil
+}
+
+// userTurn builds the user's turn for ChatAI from text and the message's attachment, downloading it
+func userTurn(account *Account, messageEvent *events.Message, text string) (ChatMessage, error) {
+	turn := ChatMessage{Role: "user", Content: text}
+	if img := messageEvent.Message.GetImageMessage(); img != nil {
+		data, err := account.Client().Download(img)
+		if err != nil {
+			return turn, fmt.Errorf("download image: %w", err)
+		}
+		turn.Images = append(turn.Images, data)
+		if turn.Content == "" {
+			turn.Content = defaultImagePrompt
+		}
+	}
+	return turn, nil
+}
+
+// mediaMessage uploads data and returns the message that sends it: an image, an
+// audio file, a video or else a document, depending on mimetype
+func (a *Account) mediaMessage(ctx context.Context, data []byte, mimetype, fileName, caption string) (*waE2E.Message, error) {
+	if mimetype == "" {
+		mimetype = http.DetectContentType(data)
+	}
+	kind := whatsmeow.MediaDocument
+	switch {
+	case strings.HasPrefix(mimetype, "image/"):
+		kind = whatsmeow.MediaImage
+	case strings.HasPrefix(mimetype, "audio/"):
+		kind = whatsmeow.MediaAudio
+	case strings.HasPrefix(mimetype, "video/"):
+		kind = whatsmeow.MediaVideo
+	}
+	uploaded, err := a.Client().Upload(ctx, data, kind)
+	if err != nil {
+		return nil, fmt.Errorf("upload %s: %w", mimetype, err)
+	}
+	switch kind {
+	case whatsmeow.MediaImage:
+		return &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimetype),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			Caption:       proto.String(caption),
+		}}, nil
+	case whatsmeow.MediaAudio:
+		// Audio has no caption
+		return &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimetype),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+		}}, nil
+	case whatsmeow.MediaVideo:
+		return &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimetype),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			Caption:       proto.String(caption),
+		}}, nil
+	}
+	if fileName == "" {
+		fileName = "file"
+	}
+	return &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
+		URL:           proto.String(uploaded.URL),
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(mimetype),
+		FileEncSHA256: uploaded.FileEncSHA256,
+		FileSHA256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(data))),
+		FileName:      proto.String(fileName),
+		Title:         proto.String(fileName),
+		Caption:       proto.String(caption),
+	}}, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Metrics in the Prometheus text format, served on /metrics of the HTTP server.
+// The few metric types the bot needs are written by hand, without a client library.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metricsRegistry []metric // In registration order
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders names and the values of key as {name="value",...}
+func formatLabels(names []string, key string, extra ...string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// CounterVec is a counter for each combination of label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+// Add adds v to the counter of labelValues
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[labelKey(labelValues)] += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the counter of labelValues
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+// HistogramVec is a histogram for each combination of label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // Upper bounds, ascending
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+// Observe records v in the histogram of labelValues
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", fmt.Sprintf("%g", bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), s.count)
+	}
+}
+
+// GaugeFunc is a gauge read when metrics are scraped
+type GaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	metricsRegistry = append(metricsRegistry, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var (
+	messagesReceived = newCounterVec("chatbot_messages_received_total", "WhatsApp messages received.", "chat_type")
+	messagesSent     = newCounterVec("chatbot_messages_sent_total", "WhatsApp messages sent, edits excluded.", "chat_type")
+	sendErrors       = newCounterVec("chatbot_send_errors_total", "WhatsApp messages that could not be sent.", "chat_type")
+
+	aiDuration = newHistogramVec("chatbot_ai_request_duration_seconds", "Duration of the requests to the AI backend, retries counted one by one.",
+		[]float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}, "operation")
+	aiTokens = newCounterVec("chatbot_ai_tokens_total", "Tokens processed by the AI backend, as reported by it (eval_count, prompt_eval_count).", "operation", "type")
+	aiErrors = newCounterVec("chatbot_ai_errors_total", "AI requests that failed after all retries.", "operation", "reason")
+)
+
+// chatType is the chat_type label of jid
+func chatType(jid types.JID) string {
+	switch jid.Server {
+	case types.GroupServer:
+		return "group"
+	case types.BroadcastServer:
+		return "broadcast"
+	}
+	return "private"
+}
+
+// observeAI records one request to the backend, started at start
+func observeAI(operation string, start time.Time, usage Usage, err error) {
+	aiDuration.Observe(time.Since(start).Seconds(), operation)
+	if err == nil {
+		aiTokens.Add(float64(usage.PromptTokens), operation, "prompt")
+		aiTokens.Add(float64(usage.CompletionTokens), operation, "completion")
+	}
+}
+
+// countAIError records an AI request that failed for good
+func countAIError(operation string, err error) {
+	reason := "error"
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, ErrBackendUnavailable):
+		reason = "unavailable"
+	case errors.As(err, &statusErr) && statusErr.Temporary():
+		reason = "busy"
+	case errors.As(err, &statusErr):
+		reason = "status"
+	}
+	aiErrors.Inc(operation, reason)
+}
+
+func init() {
+	// Registered here rather than with the variables, to keep the order of the output
+	newGaugeFunc("chatbot_active_conversations", "Conversations with history that has not expired.", func() float64 {
+		if history == nil {
+			return 0
+		}
+		n, _ := history.Active()
+		return float64(n)
+	})
+	newGaugeFunc("chatbot_whatsapp_connected", "Accounts whose WhatsApp websocket is connected.", func() float64 {
+		return float64(countAccounts((*whatsmeow.Client).IsConnected))
+	})
+	newGaugeFunc("chatbot_whatsapp_logged_in", "Accounts whose WhatsApp session is logged in.", func() float64 {
+		return float64(countAccounts((*whatsmeow.Client).IsLoggedIn))
+	})
+	newGaugeFunc("go_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	newGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.HeapAlloc)
+	})
+
+	httpMux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metricsRegistry {
+			m.write(w)
+		}
+	})
+}
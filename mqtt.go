@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The MQTT bridge connects the bot to the home sensors and devices: messages
+// published on the forward topics are sent to WhatsApp contacts, and the MQTT
+// commands publish what is typed in WhatsApp, e.g. to switch a device.
+
+const mqttTimeout = 10 * time.Second
+
+// MQTTConfig selects the broker and what goes through it
+type MQTTConfig struct {
+	Broker   string        `yaml:"broker"` // e.g. tcp://localhost:1883; "" disables MQTT
+	ClientID string        `yaml:"client_id"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Forward  []MQTTForward `yaml:"forward"`
+	Commands []MQTTCommand `yaml:"commands"`
+}
+
+// MQTTForward sends the messages of Topic to WhatsApp
+type MQTTForward struct {
+	Topic       string        `yaml:"topic"`        // May contain the + and # wildcards
+	To          []string      `yaml:"to"`           // Phone numbers or JIDs, groups included
+	Match       string        `yaml:"match"`        // Regular expression the payload must match; "" forwards everything
+	Template    string        `yaml:"template"`     // Go template of the text, with .Topic, .Payload and .JSON
+	MinInterval time.Duration `yaml:"min_interval"` // Drop messages coming sooner than this after the last one forwarded
+}
+
+// MQTTCommand is a bot command that publishes on Topic
+type MQTTCommand struct {
+	Name    string `yaml:"name"`
+	Topic   string `yaml:"topic"`
+	Payload string `yaml:"payload"` // Go template, with .Args, .Sender and .Chat; "" sends the arguments
+	Role    string `yaml:"role"`    // Who may use it: user, admin or owner; "" is admin
+	Retain  bool   `yaml:"retain"`
+	Help    string `yaml:"help"`
+}
+
+// mqttForward is an MQTTForward ready to use
+type mqttForward struct {
+	MQTTForward
+	to       []types.JID
+	match    *regexp.Regexp
+	template *template.Template
+
+	mu   sync.Mutex
+	last time.Time // Last message forwarded
+}
+
+// MQTTBridge is the connection to the broker
+type MQTTBridge struct {
+	client   mqtt.Client
+	forwards []*mqttForward
+}
+
+var mqttBridge *MQTTBridge // nil when no broker is configured
+
+func NewMQTTBridge(cfg MQTTConfig) (*MQTTBridge, error) {
+	b := &MQTTBridge{}
+	for i, f := range cfg.Forward {
+		fw := &mqttForward{MQTTForward: f}
+		if f.Topic == "" || len(f.To) == 0 {
+			return nil, fmt.Errorf("mqtt.forward[%d]: topic and to are required", i)
+		}
+		for _, to := range f.To {
+			jid, err := ParseContact(to)
+			if err != nil {
+				return nil, fmt.Errorf("mqtt.forward[%d]: %w", i, err)
+			}
+			fw.to = append(fw.to, jid)
+		}
+		if f.Match != "" {
+			var err error
+			if fw.match, err = regexp.Compile(f.Match); err != nil {
+				return nil, fmt.Errorf("mqtt.forward[%d].match: %w", i, err)
+			}
+		}
+		text := f.Template
+		if text == "" {
+			text = "{{.Topic}}: {{.Payload}}"
+		}
+		var err error
+		if fw.template, err = template.New(f.Topic).Parse(text); err != nil {
+			return nil, fmt.Errorf("mqtt.forward[%d].template: %w", i, err)
+		}
+		b.forwards = append(b.forwards, fw)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false). // A slow WhatsApp send must not hold the other messages
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost, reconnecting: %v", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	return b, nil
+}
+
+// Connect starts connecting to the broker; it keeps trying in the background if the broker is down
+func (b *MQTTBridge) Connect() {
+	if token := b.client.Connect(); token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		log.Printf("MQTT connection failed: %v", token.Error())
+	}
+}
+
+// subscribe (re)subscribes the forward topics, on every connection
+func (b *MQTTBridge) subscribe(client mqtt.Client) {
+	log.Printf("MQTT connected")
+	for _, f := range b.forwards {
+		token := client.Subscribe(f.Topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			f.forward(msg.Topic(), string(msg.Payload()))
+		})
+		if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+			log.Printf("MQTT cannot subscribe %s: %v", f.Topic, token.Error())
+		}
+	}
+}
+
+// forward sends a message of topic to the contacts of f, if it matches
+func (f *mqttForward) forward(topic, payload string) {
+	if f.match != nil && !f.match.MatchString(payload) {
+		return
+	}
+	f.mu.Lock()
+	if f.MinInterval > 0 && time.Since(f.last) < f.MinInterval {
+		f.mu.Unlock()
+		log.Printf("MQTT: dropped message on %s, sent one less than %s ago", topic, f.MinInterval)
+		return
+	}
+	f.last = time.Now()
+	f.mu.Unlock()
+
+	data := struct {
+		Topic, Payload string
+		JSON           interface{} // The payload decoded, if it is JSON
+	}{Topic: topic, Payload: payload}
+	json.Unmarshal([]byte(payload), &data.JSON)
+	var text strings.Builder
+	if err := f.template.Execute(&text, data); err != nil {
+		log.Printf("MQTT: template of %s failed: %v", f.Topic, err)
+		return
+	}
+	for _, jid := range f.to {
+		if err := primaryAccount().SendText(jid, text.String()); err != nil {
+			log.Printf("MQTT: cannot forward %s to %s: %v", topic, jid, err)
+		}
+	}
+}
+
+// Publish sends payload on topic and waits for the broker to take it
+func (b *MQTTBridge) Publish(topic, payload string, retain bool) error {
+	token := b.client.Publish(topic, 1, retain, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("publish on %s: no answer from the broker", topic)
+	}
+	return token.Error()
+}
+
+// Disconnect closes the connection, letting pending messages go out
+func (b *MQTTBridge) Disconnect() {
+	b.client.Disconnect(250)
+}
+
+// RegisterMQTTCommands adds the commands of the configuration; call it before the aliases are added
+func RegisterMQTTCommands(cmds []MQTTCommand) error {
+	for _, c := range cmds {
+		if c.Name == "" || c.Topic == "" {
+			return fmt.Errorf("mqtt.commands: name and topic are required")
+		}
+		if _, exists := commands[strings.ToLower(c.Name)]; exists {
+			return fmt.Errorf("mqtt.commands: %s is already a command", c.Name)
+		}
+		level := LevelAdmin
+		if c.Role != "" {
+			var err error
+			if level, err = ParseRole(c.Role); err != nil || level < LevelUser {
+				return fmt.Errorf("mqtt.commands.%s: role must be user, admin or owner", c.Name)
+			}
+		}
+		payload := c.Payload
+		if payload == "" {
+			payload = "{{.Args}}"
+		}
+		tmpl, err := template.New(c.Name).Parse(payload)
+		if err != nil {
+			return fmt.Errorf("mqtt.commands.%s.payload: %w", c.Name, err)
+		}
+		help := c.Help
+		if help == "" {
+			help = "publish on " + c.Topic
+		}
+		RegisterCommand(&Command{
+			Name:    c.Name,
+			Args:    "[text]",
+			Help:    help,
+			Level:   level,
+			MaxArgs: AnyArgs,
+			Run: func(ctx *CommandContext) {
+				if mqttBridge == nil {
+					ctx.Reply("MQTT is not configured.")
+					return
+				}
+				var sb strings.Builder
+				err := tmpl.Execute(&sb, struct{ Args, Sender, Chat string }{
+					strings.Join(ctx.Args, " "), ctx.Sender.User, ctx.Chat.String(),
+				})
+				if err != nil {
+					log.Printf("MQTT: payload of %s failed: %v", c.Name, err)
+					ctx.Reply("Cannot build the message, see the log.")
+					return
+				}
+				if err := mqttBridge.Publish(c.Topic, sb.String(), c.Retain); err != nil {
+					log.Printf("MQTT: %v", err)
+					ctx.Reply("Cannot publish on " + c.Topic + ": " + err.Error())
+					return
+				}
+				ctx.Reply("📡 " + c.Topic + ": " + sb.String())
+			},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mdp/qrterminal"
+	"go.mau.fi/whatsmeow"
+	"rsc.io/qr"
+)
+
+// Pairing links a new WhatsApp session. The QR code is printed on the terminal;
+// on a headless Pi the bot can instead ask for an 8-character code to type in the
+// phone (pairing.phone), or show the QR on a page of the HTTP server (pairing.web).
+
+const (
+	// Wait after a failed connection before pairing again, doubled up to pairMaxBackoff
+	pairBackoff    = 5 * time.Second
+	pairMaxBackoff = 5 * time.Minute
+)
+
+// pairingCode is what the /pair page shows of an account being paired
+type pairingCode struct {
+	QR   string // Content of the current QR code
+	Code string // Current pairing code, if asked
+}
+
+var pairingState struct {
+	mu       sync.Mutex
+	accounts map[string]pairingCode // By account name, only while pairing
+}
+
+func setPairing(account, qr, code string) {
+	pairingState.mu.Lock()
+	defer pairingState.mu.Unlock()
+	if pairingState.accounts == nil {
+		pairingState.accounts = make(map[string]pairingCode)
+	}
+	if qr == "" {
+		delete(pairingState.accounts, account)
+	} else {
+		pairingState.accounts[account] = pairingCode{qr, code}
+	}
+}
+
+// Pair links the account to a phone, starting again whenever the codes run out, until it succeeds
+func Pair(a *Account) {
+	client := a.Client()
+	phone := a.pairPhone()
+	backoff := pairBackoff
+	retry := func(what string, err error) {
+		log.Printf("Cannot %s to pair %s, trying again in %s: %v", what, a.Name, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, pairMaxBackoff)
+	}
+	for client.Store.ID == nil {
+		qrChan, err := client.GetQRChannel(context.Background())
+		if err != nil {
+			client.Disconnect()
+			retry("get the QR codes", err)
+			continue
+		}
+		if err := client.Connect(); err != nil {
+			retry("connect", err)
+			continue
+		}
+		backoff = pairBackoff
+		var code string
+		var failure error
+		for evt := range qrChan {
+			if evt.Event != "code" {
+				log.Println("Login event:", evt.Event)
+				failure = evt.Error
+				continue
+			}
+			if phone != "" && code == "" {
+				// One code per connection, it lasts as long as the QR codes
+				var err error
+				code, err = client.PairPhone(phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+				if err != nil {
+					log.Printf("Cannot get a pairing code for %s: %v", phone, err)
+				} else {
+					log.Printf("Pairing code of %s: %s (on the phone: Linked devices > Link a device > Link with phone number instead)", a.Name, code)
+				}
+			}
+			if code == "" {
+				// Without a phone, or when the pairing code could not be had
+				log.Printf("Scan this QR code to pair %s:", a.Name)
+				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
+			}
+			setPairing(a.Name, evt.Code, code)
+		}
+		setPairing(a.Name, "", "")
+		if client.Store.ID == nil {
+			client.Disconnect()
+			if failure != nil {
+				// The codes did not just run out
+				retry("link the phone", failure)
+			}
+		}
+	}
+}
+
+var pairPage = template.Must(template.New("pair").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="5"><title>WhatsApp bot pairing</title></head>
+<body style="font-family: sans-serif; text-align: center">
+{{range $name, $p := .Pairing}}
+<h1>Link {{$name}}</h1>
+<p>On the phone: WhatsApp &gt; Linked devices &gt; Link a device, then scan the code.</p>
+<img src="/pair/qr.png?account={{$name}}&amp;v={{$p.QR}}" alt="QR code" width="400" height="400">
+{{if $p.Code}}<p>Or choose "Link with phone number instead" and type <b style="font-size: 2em">{{$p.Code}}</b></p>{{end}}
+{{else}}
+<h1>No account is being paired</h1>
+{{end}}
+{{range .LoggedIn}}<p>{{.}} is linked.</p>{{end}}
+</body></html>
+`))
+
+func init() {
+	httpMux.HandleFunc("GET /pair", func(w http.ResponseWriter, r *http.Request) {
+		if !config.Pairing.Web {
+			http.NotFound(w, r)
+			return
+		}
+		var data struct {
+			Pairing  map[string]pairingCode
+			LoggedIn []string
+		}
+		pairingState.mu.Lock()
+		data.Pairing = make(map[string]pairingCode)
+		for name, p := range pairingState.accounts {
+			data.Pairing[name] = p
+		}
+		pairingState.mu.Unlock()
+		for _, a := range accounts {
+			if client := a.Client(); client != nil && client.IsLoggedIn() {
+				data.LoggedIn = append(data.LoggedIn, a.Name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := pairPage.Execute(w, data); err != nil {
+			log.Printf("Cannot write the pairing page: %v", err)
+		}
+	})
+	httpMux.HandleFunc("GET /pair/qr.png", func(w http.ResponseWriter, r *http.Request) {
+		pairingState.mu.Lock()
+		content := pairingState.accounts[r.URL.Query().Get("account")].QR
+		pairingState.mu.Unlock()
+		if !config.Pairing.Web || content == "" {
+			http.NotFound(w, r)
+			return
+		}
+		code, err := qr.Encode(content, qr.L)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(code.PNG())
+	})
+}
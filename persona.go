@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Personas give the bot a tone and a language: a system prompt sent before every
+// conversation, and optionally their own model and temperature. A chat talks to
+// the persona chosen with the persona command, else the one configured for it in
+// chat_personas, else the persona of the account.
+
+const personaSetting = "persona"
+
+// Persona is a character the bot answers as
+type Persona struct {
+	Description  string   `yaml:"description"`   // Shown by the persona command
+	SystemPrompt string   `yaml:"system_prompt"` // Given to the model before every conversation
+	Model        string   `yaml:"model"`         // "" is the account's model
+	VisionModel  string   `yaml:"vision_model"`  // "" is the account's vision model
+	Temperature  *float64 `yaml:"temperature"`   // nil leaves the backend's default
+}
+
+// PersonaName returns the name of the persona chat talks to, "" for none;
+// an empty chat, such as an API conversation, gets the account's persona
+func (a *Account) PersonaName(chat types.JID) string {
+	if !chat.IsEmpty() {
+		chat = chat.ToNonAD()
+		if name, ok := settings.Get(chat, a.SettingKey(personaSetting)); ok {
+			if _, exists := config.Personas[name]; exists {
+				return name
+			}
+		}
+		if name, ok := config.ChatPersonas[chat.String()]; ok {
+			return name
+		}
+	}
+	return a.Persona
+}
+
+// PersonaOf returns the persona chat talks to, with the account's models where it names none
+func (a *Account) PersonaOf(chat types.JID) Persona {
+	p := config.Personas[a.PersonaName(chat)]
+	if p.Model == "" {
+		p.Model = a.Model
+	}
+	if p.VisionModel == "" {
+		p.VisionModel = a.VisionModel
+	}
+	return p
+}
+
+// personaList describes the configured personas, marking current
+func personaList(current string) string {
+	names := make([]string, 0, len(config.Personas))
+	for name := range config.Personas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		mark := "  "
+		if name == current {
+			mark = "▶ "
+		}
+		sb.WriteString("\n" + mark + name)
+		if d := config.Personas[name].Description; d != "" {
+			sb.WriteString(" - " + d)
+		}
+	}
+	return sb.String()
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "persona",
+		Args:    "[name|default]",
+		Help:    "show or change who the bot answers as in this chat",
+		Level:   LevelUser,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			if len(config.Personas) == 0 {
+				ctx.Reply("No personas are configured on this bot.")
+				return
+			}
+			current := ctx.Account.PersonaName(ctx.Chat)
+			if len(ctx.Args) == 0 {
+				reply := "Personas:" + personaList(current)
+				if current == "" {
+					reply = "No persona in this chat.\n" + reply
+				}
+				ctx.Reply(reply + "\nSend persona <name> to change it.")
+				return
+			}
+			if ctx.Chat.Server == types.GroupServer && ctx.Level < LevelAdmin {
+				ctx.Reply("Only admins can change the persona of a group.")
+				return
+			}
+			name := strings.ToLower(ctx.Args[0])
+			var err error
+			if name == "default" {
+				err = settings.Delete(ctx.Chat, ctx.Account.SettingKey(personaSetting))
+			} else if _, ok := config.Personas[name]; !ok {
+				ctx.Reply("There is no persona " + name + ". Personas:" + personaList(current))
+				return
+			} else {
+				err = settings.Set(ctx.Chat, ctx.Account.SettingKey(personaSetting), name)
+			}
+			if err != nil {
+				log.Printf("Cannot save persona of %s: %v", ctx.Chat, err)
+				ctx.Reply("Cannot save the setting, see the log.")
+				return
+			}
+			// The answers so far were in another voice: start again
+			if err := history.Reset(ctx.Account.HistoryKey(ctx.Chat)); err != nil {
+				log.Printf("Cannot reset the history of %s: %v", ctx.Chat, err)
+			}
+			if current = ctx.Account.PersonaName(ctx.Chat); current == "" {
+				ctx.Reply("Back to no persona. The conversation starts again.")
+			} else {
+				ctx.Reply("Persona " + current + ". The conversation starts again.")
+			}
+		},
+	})
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Reminders and scheduled messages. The time is said in plain words and turned
+// into a schedule by the model; schedules are kept in SQLite, so they survive
+// restarts, and one missed while the bot was off fires as soon as it is back.
+
+const remindersSchema = `
+CREATE TABLE IF NOT EXISTS reminders (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	account    TEXT NOT NULL DEFAULT '',
+	chat       TEXT NOT NULL,
+	creator    TEXT NOT NULL,
+	text       TEXT NOT NULL,
+	action     TEXT NOT NULL,
+	repeat     TEXT NOT NULL,
+	next_run   INTEGER,
+	day        INTEGER NOT NULL DEFAULT 0,
+	fired_at   INTEGER,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reminders_next_run ON reminders(next_run);
+`
+
+const (
+	defaultSnooze  = 10 * time.Minute
+	firedRetention = 24 * time.Hour // One-time reminders can be snoozed for this long after firing
+	reminderLayout = "Mon 2 Jan 15:04"
+)
+
+// Actions of a reminder
+const (
+	actionRemind = "remind" // Send the text
+	actionAsk    = "ask"    // Send the AI's answer to the text
+)
+
+// repeatNames are the supported repetitions, as shown to the user
+var repeatNames = map[string]string{
+	"hourly":   "every hour",
+	"daily":    "every day",
+	"weekdays": "every weekday",
+	"weekly":   "every week",
+	"monthly":  "every month",
+}
+
+// Reminder is a message to send to Chat at NextRun, and again every Repeat
+type Reminder struct {
+	ID      int64
+	Account string // Key of the account that sends it
+	Chat    types.JID
+	Creator types.JID
+	Text    string
+	Action  string
+	Repeat  string // "" for once, else a key of repeatNames
+	NextRun time.Time
+	Day     int  // Day of the month of the first occurrence, kept by monthly reminders in longer months
+	Fired   bool // Whether it fired at least once
+}
+
+// String is the reminder as listed to the user
+func (r Reminder) String() string {
+	s := fmt.Sprintf("#%d %s", r.ID, r.NextRun.Format(reminderLayout))
+	if r.Repeat != "" {
+		s += ", " + repeatNames[r.Repeat]
+	}
+	if r.Action == actionAsk {
+		return s + ": ask " + strconv.Quote(r.Text)
+	}
+	return s + ": " + r.Text
+}
+
+// nextRun returns when a reminder repeating every repeat fires after t; monthly
+// reminders fire on day, or on the last day of shorter months
+func nextRun(t time.Time, repeat string, day int) time.Time {
+	switch repeat {
+	case "hourly":
+		return t.Add(time.Hour)
+	case "daily":
+		return t.AddDate(0, 0, 1)
+	case "weekdays":
+		t = t.AddDate(0, 0, 1)
+		for t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t
+	case "weekly":
+		return t.AddDate(0, 0, 7)
+	case "monthly":
+		// 31 January: the last day of February, not 3 March, then 31 March again
+		first := time.Date(t.Year(), t.Month()+1, 1, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+		last := first.AddDate(0, 1, -1).Day()
+		return first.AddDate(0, 0, min(day, last)-1)
+	}
+	return time.Time{}
+}
+
+// ReminderStore keeps the reminders of every chat
+type ReminderStore struct {
+	db      *sql.DB
+	answers map[int64]string // Answers of ask reminders not sent yet, by ID, so a new try does not ask again
+}
+
+var reminders *ReminderStore
+
+func NewReminderStore(db *sql.DB) (*ReminderStore, error) {
+	if _, err := db.Exec(remindersSchema); err != nil {
+		return nil, fmt.Errorf("create reminders table: %w", err)
+	}
+	if err := addColumn(db, "reminders", "account", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "reminders", "day", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	return &ReminderStore{db: db, answers: make(map[int64]string)}, nil
+}
+
+// Add stores r and returns it with its ID
+func (s *ReminderStore) Add(r Reminder) (Reminder, error) {
+	if r.Day == 0 {
+		r.Day = r.NextRun.Day()
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO reminders (account, chat, creator, text, action, repeat, next_run, day, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Account, r.Chat.ToNonAD().String(), r.Creator.ToNonAD().String(), r.Text, r.Action, r.Repeat, r.NextRun.Unix(), r.Day, time.Now().Unix())
+	if err != nil {
+		return r, err
+	}
+	r.ID, err = res.LastInsertId()
+	return r, err
+}
+
+func (s *ReminderStore) query(where string, args ...interface{}) ([]Reminder, error) {
+	rows, err := s.db.Query(`SELECT id, account, chat, creator, text, action, repeat, COALESCE(next_run, 0), day, fired_at IS NOT NULL FROM reminders WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Reminder
+	for rows.Next() {
+		var r Reminder
+		var chat, creator string
+		var next int64
+		if err := rows.Scan(&r.ID, &r.Account, &chat, &creator, &r.Text, &r.Action, &r.Repeat, &next, &r.Day, &r.Fired); err != nil {
+			return nil, err
+		}
+		r.Chat, _ = types.ParseJID(chat)
+		r.Creator, _ = types.ParseJID(creator)
+		r.NextRun = time.Unix(next, 0)
+		if r.Day == 0 {
+			r.Day = r.NextRun.Day() // Stored before the day was
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// List returns the pending reminders of chat with account, soonest first
+func (s *ReminderStore) List(account string, chat types.JID) ([]Reminder, error) {
+	return s.query(`account = ? AND chat = ? AND next_run IS NOT NULL ORDER BY next_run`, account, chat.ToNonAD().String())
+}
+
+// Get returns the reminder id of chat with account, pending or recently fired
+func (s *ReminderStore) Get(account string, chat types.JID, id int64) (Reminder, bool, error) {
+	list, err := s.query(`account = ? AND chat = ? AND id = ?`, account, chat.ToNonAD().String(), id)
+	if err != nil || len(list) == 0 {
+		return Reminder{}, false, err
+	}
+	return list[0], true, nil
+}
+
+// LastFired returns the reminder of chat with account that fired last, for snoozing it
+func (s *ReminderStore) LastFired(account string, chat types.JID) (Reminder, bool, error) {
+	list, err := s.query(`account = ? AND chat = ? AND fired_at IS NOT NULL ORDER BY fired_at DESC, id DESC LIMIT 1`, account, chat.ToNonAD().String())
+	if err != nil || len(list) == 0 {
+		return Reminder{}, false, err
+	}
+	return list[0], true, nil
+}
+
+// Cancel deletes the reminder id
+func (s *ReminderStore) Cancel(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM reminders WHERE id = ?`, id)
+	return err
+}
+
+// Reschedule moves the next occurrence of id to next
+func (s *ReminderStore) Reschedule(id int64, next time.Time) error {
+	_, err := s.db.Exec(`UPDATE reminders SET next_run = ? WHERE id = ?`, next.Unix(), id)
+	return err
+}
+
+// Fired records that id fired and schedules it at next, or never again if next is zero
+func (s *ReminderStore) Fired(id int64, next time.Time) error {
+	var nextRun interface{}
+	if !next.IsZero() {
+		nextRun = next.Unix()
+	}
+	_, err := s.db.Exec(`UPDATE reminders SET next_run = ?, fired_at = ? WHERE id = ?`, nextRun, time.Now().Unix(), id)
+	return err
+}
+
+// Loop fires the due reminders, checking every interval
+func (s *ReminderStore) Loop(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		due, err := s.query(`next_run <= ? ORDER BY next_run`, now.Unix())
+		if err != nil {
+			log.Printf("Cannot look for due reminders: %v", err)
+			continue
+		}
+		for _, r := range due {
+			s.fire(r, now.Sub(r.NextRun) > 2*interval)
+		}
+		// Fired one-time reminders are kept for a while, to be snoozed
+		_, err = s.db.Exec(`DELETE FROM reminders WHERE next_run IS NULL AND fired_at < ?`, now.Add(-firedRetention).Unix())
+		if err != nil {
+			log.Printf("Cannot delete old reminders: %v", err)
+		}
+	}
+}
+
+// fire sends r; late means it should have fired while the bot was off
+func (s *ReminderStore) fire(r Reminder, late bool) {
+	a, ok := findAccount(r.Account)
+	if !ok {
+		log.Printf("Dropping reminder #%d of the account %s, no longer configured", r.ID, r.Account)
+		s.Cancel(r.ID)
+		return
+	}
+	// The reminder acts for its creator, who may have lost access since
+	level := a.LevelIn(r.Chat, r.Creator)
+	if level < LevelUser {
+		log.Printf("Dropping reminder #%d of %s (%s)", r.ID, r.Creator, level)
+		s.Cancel(r.ID)
+		return
+	}
+	if !a.Client().IsLoggedIn() {
+		return // Due again at the next check
+	}
+	text := "⏰ " + r.Text
+	if r.Action == actionAsk {
+		answer, asked := s.answers[r.ID]
+		if !asked {
+			var err error
+			answer, err = ChatAIStream(a.HistoryKey(r.Chat), a.PersonaOf(r.Chat), level, ChatMessage{Role: "user", Content: r.Text}, nil)
+			if err != nil {
+				log.Printf("AI chat for reminder #%d failed: %v", r.ID, err)
+				answer = "[" + aiErrorReply(err) + "]"
+			}
+			s.answers[r.ID] = answer
+		}
+		text += "\n\n" + answer
+	}
+	if late {
+		text += "\n(late: due " + r.NextRun.Format(reminderLayout) + ")"
+	}
+	if err := a.SendText(r.Chat, text); err != nil {
+		log.Printf("Cannot send reminder #%d to %s, will try again: %v", r.ID, r.Chat, err)
+		return
+	}
+	log.Printf("Reminder #%d sent to %s", r.ID, r.Chat)
+	delete(s.answers, r.ID)
+
+	var next time.Time
+	if r.Repeat != "" {
+		// Skip the occurrences missed while the bot was off
+		for next = nextRun(r.NextRun, r.Repeat, r.Day); !next.After(time.Now()); next = nextRun(next, r.Repeat, r.Day) {
+		}
+	}
+	if err := s.Fired(r.ID, next); err != nil {
+		log.Printf("Cannot update reminder #%d: %v", r.ID, err)
+	}
+}
+
+// scheduleRequest is how the model describes a schedule
+type scheduleRequest struct {
+	When   string `json:"when"`
+	Repeat string `json:"repeat"`
+	Action string `json:"action"`
+	Text   string `json:"text"`
+	Error  string `json:"error"`
+}
+
+const scheduleLayout = "2006-01-02 15:04"
+
+// parseSchedule asks the model to turn a request such as "remind me tomorrow at 9
+// to call Marco" into a reminder, not yet stored
+func parseSchedule(model, request string, now time.Time) (Reminder, error) {
+	prompt := fmt.Sprintf(`It is now %s, %s.
+Turn the request below into a schedule. Answer only with JSON like this:
+{"when": "%s", "repeat": "none", "action": "remind", "text": "Call Marco"}
+- when: local date and time of the first occurrence, after now, as YYYY-MM-DD HH:MM
+- repeat: none, hourly, daily, weekdays, weekly or monthly
+- action: remind to send the text as a reminder; ask if the text is a request for the AI, to be answered at that time (e.g. "send the weekly summary", "tell me the weather")
+- text: what to remind or ask, without the time, in the language of the request
+If the request says no time, answer {"error": "no time given"}.
+
+Request: %s`, now.Weekday(), now.Format(scheduleLayout), now.Add(24*time.Hour).Format("2006-01-02")+" 09:00", request)
+	answer, err := GenerateAI(model, prompt)
+	if err != nil {
+		return Reminder{}, err
+	}
+	start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return Reminder{}, fmt.Errorf("no schedule in %q", answer)
+	}
+	var req scheduleRequest
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &req); err != nil {
+		return Reminder{}, fmt.Errorf("parse schedule %q: %w", answer, err)
+	}
+	if req.Error != "" {
+		return Reminder{}, errors.New(req.Error)
+	}
+
+	r := Reminder{Text: strings.TrimSpace(req.Text), Action: strings.ToLower(req.Action), Repeat: strings.ToLower(req.Repeat)}
+	if r.Repeat == "none" {
+		r.Repeat = ""
+	}
+	if _, ok := repeatNames[r.Repeat]; r.Repeat != "" && !ok {
+		return Reminder{}, fmt.Errorf("unknown repetition %q", req.Repeat)
+	}
+	if r.Action != actionAsk {
+		r.Action = actionRemind
+	}
+	if r.Text == "" {
+		return Reminder{}, errors.New("nothing to remind")
+	}
+	r.NextRun, err = time.ParseInLocation(scheduleLayout, strings.TrimSpace(req.When), time.Local)
+	if err != nil {
+		return Reminder{}, fmt.Errorf("parse time %q: %w", req.When, err)
+	}
+	r.Day = r.NextRun.Day()
+	for r.Repeat != "" && !r.NextRun.After(now) {
+		r.NextRun = nextRun(r.NextRun, r.Repeat, r.Day)
+	}
+	if !r.NextRun.After(now) {
+		return Reminder{}, fmt.Errorf("%s is in the past", r.NextRun.Format(reminderLayout))
+	}
+	return r, nil
+}
+
+// parseReminderID accepts 12 and #12
+func parseReminderID(arg string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	return id, err == nil
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "remind",
+		Aliases: []string{"schedule"},
+		Args:    "<when> <what>",
+		Help:    "e.g. remind me tomorrow at 9 to call Marco, remind 10m pizza, schedule every Monday 8:00 send the weekly summary",
+		Level:   LevelUser,
+		MinArgs: 1,
+		MaxArgs: AnyArgs,
+		Run: func(ctx *CommandContext) {
+			var r Reminder
+			if d, err := parseTTL(ctx.Args[0]); err == nil && len(ctx.Args) > 1 {
+				// remind 10m ...: no need to ask the model
+				r = Reminder{Text: strings.Join(ctx.Args[1:], " "), Action: actionRemind, NextRun: time.Now().Add(d).Truncate(time.Second)}
+			} else if r, err = parseSchedule(ctx.Account.PersonaOf(ctx.Chat).Model, ctx.Text, time.Now()); err != nil {
+				log.Printf("Cannot understand the schedule %q: %v", ctx.Text, err)
+				ctx.Reply("Sorry, I could not understand when (" + err.Error() + "). Try e.g.: remind me tomorrow at 9 to call Marco")
+				return
+			}
+			r.Account, r.Chat, r.Creator = ctx.Account.Key(), ctx.Chat, ctx.Sender
+			r, err := reminders.Add(r)
+			if err != nil {
+				log.Printf("Cannot save reminder: %v", err)
+				ctx.Reply("Cannot save the reminder, see the log.")
+				return
+			}
+			ctx.Reply("⏰ OK: " + r.String() + "\nSend cancel " + strconv.FormatInt(r.ID, 10) + " if this is wrong.")
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "reminders",
+		Help:  "list the reminders of this chat",
+		Level: LevelUser,
+		Run: func(ctx *CommandContext) {
+			list, err := reminders.List(ctx.Account.Key(), ctx.Chat)
+			if err != nil {
+				log.Printf("Cannot list reminders: %v", err)
+				ctx.Reply("Cannot list reminders, see the log.")
+				return
+			}
+			if len(list) == 0 {
+				ctx.Reply("No reminders. Send e.g.: remind me tomorrow at 9 to call Marco")
+				return
+			}
+			var sb strings.Builder
+			sb.WriteString("Reminders:")
+			for _, r := range list {
+				sb.WriteString("\n" + r.String())
+			}
+			ctx.Reply(sb.String())
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "cancel",
+		Args:    "<number>",
+		Help:    "delete a reminder, see reminders",
+		Level:   LevelUser,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			id, ok := parseReminderID(ctx.Args[0])
+			if !ok {
+				ctx.Reply("Usage: cancel <number>, the numbers are in reminders")
+				return
+			}
+			r, found, err := reminders.Get(ctx.Account.Key(), ctx.Chat, id)
+			if err != nil {
+				log.Printf("Cannot load reminder #%d: %v", id, err)
+				ctx.Reply("Cannot load the reminder, see the log.")
+				return
+			}
+			if !found {
+				ctx.Reply("There is no reminder #" + strconv.FormatInt(id, 10) + " in this chat.")
+				return
+			}
+			if r.Creator != ctx.Sender.ToNonAD() && ctx.Level < LevelAdmin {
+				ctx.Reply("Only who created it, or an admin, can cancel #" + strconv.FormatInt(id, 10) + ".")
+				return
+			}
+			if err := reminders.Cancel(id); err != nil {
+				log.Printf("Cannot cancel reminder #%d: %v", id, err)
+				ctx.Reply("Cannot cancel the reminder, see the log.")
+				return
+			}
+			ctx.Reply("Cancelled #" + strconv.FormatInt(id, 10) + ".")
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "snooze",
+		Args:    "[number] [duration]",
+		Help:    "remind again later, by default the last reminder in 10 minutes",
+		Level:   LevelUser,
+		MaxArgs: 2,
+		Run: func(ctx *CommandContext) {
+			var id int64
+			wait := defaultSnooze
+			for _, arg := range ctx.Args {
+				if d, err := parseTTL(arg); err == nil {
+					wait = d
+				} else if n, ok := parseReminderID(arg); ok {
+					id = n
+				} else {
+					ctx.Reply("Usage: " + commands["snooze"].Usage() + ", e.g. snooze 30m")
+					return
+				}
+			}
+			var r Reminder
+			var found bool
+			var err error
+			if id != 0 {
+				r, found, err = reminders.Get(ctx.Account.Key(), ctx.Chat, id)
+			} else {
+				r, found, err = reminders.LastFired(ctx.Account.Key(), ctx.Chat)
+			}
+			if err != nil {
+				log.Printf("Cannot load reminder to snooze: %v", err)
+				ctx.Reply("Cannot load the reminder, see the log.")
+				return
+			}
+			if !found {
+				ctx.Reply("No reminder to snooze.")
+				return
+			}
+			next := time.Now().Add(wait).Truncate(time.Second)
+			if r.Repeat == "" || !r.Fired {
+				// Still to come, or fired once and for all: the reminder itself moves
+				r.NextRun = next
+				err = reminders.Reschedule(r.ID, next)
+			} else {
+				// A one-time copy: a repeating reminder keeps its schedule
+				r.Creator = ctx.Sender
+				r.Repeat = ""
+				r.NextRun = next
+				r, err = reminders.Add(r)
+			}
+			if err != nil {
+				log.Printf("Cannot save snoozed reminder: %v", err)
+				ctx.Reply("Cannot save the reminder, see the log.")
+				return
+			}
+			ctx.Reply("💤 " + r.String())
+		},
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRun(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 30, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		from   time.Time
+		repeat string
+		day    int
+		want   time.Time
+	}{
+		{"hourly", at(2024, time.March, 10, 23), "hourly", 10, at(2024, time.March, 11, 0)},
+		{"daily", at(2024, time.February, 28, 9), "daily", 28, at(2024, time.February, 29, 9)},
+		{"weekdays from Thursday", at(2024, time.March, 7, 9), "weekdays", 7, at(2024, time.March, 8, 9)},
+		{"weekdays from Friday", at(2024, time.March, 8, 9), "weekdays", 8, at(2024, time.March, 11, 9)},
+		{"weekdays from Saturday", at(2024, time.March, 9, 9), "weekdays", 9, at(2024, time.March, 11, 9)},
+		{"weekly", at(2024, time.December, 28, 9), "weekly", 28, at(2025, time.January, 4, 9)},
+		{"monthly", at(2024, time.March, 15, 9), "monthly", 15, at(2024, time.April, 15, 9)},
+		{"monthly into December", at(2024, time.November, 15, 9), "monthly", 15, at(2024, time.December, 15, 9)},
+		{"monthly into January", at(2024, time.December, 15, 9), "monthly", 15, at(2025, time.January, 15, 9)},
+		{"monthly 31 into February", at(2025, time.January, 31, 9), "monthly", 31, at(2025, time.February, 28, 9)},
+		{"monthly 31 into leap February", at(2024, time.January, 31, 9), "monthly", 31, at(2024, time.February, 29, 9)},
+		{"monthly 31 after February", at(2025, time.February, 28, 9), "monthly", 31, at(2025, time.March, 31, 9)},
+		{"monthly 31 into April", at(2025, time.March, 31, 9), "monthly", 31, at(2025, time.April, 30, 9)},
+		{"monthly 30 after February", at(2025, time.February, 28, 9), "monthly", 30, at(2025, time.March, 30, 9)},
+		{"once", at(2024, time.March, 15, 9), "", 15, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextRun(tt.from, tt.repeat, tt.day); !got.Equal(tt.want) {
+				t.Errorf("nextRun(%s, %q, %d) = %s, want %s", tt.from, tt.repeat, tt.day, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRunMonthlyKeepsDay(t *testing.T) {
+	next := time.Date(2025, time.January, 31, 9, 0, 0, 0, time.UTC)
+	want := []int{28, 31, 30, 31, 30, 31}
+	for i, day := range want {
+		next = nextRun(next, "monthly", 31)
+		if next.Day() != day || next.Month() != time.Month(i+2) {
+			t.Fatalf("occurrence %d is %s, want day %d of %s", i+1, next, day, time.Month(i+2))
+		}
+	}
+}
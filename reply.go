@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	editInterval     = 2 * time.Second  // Minimum time between two edits of a streamed reply
+	presenceInterval = 10 * time.Second // WhatsApp drops "typing…" after ~25s unless it is sent again
+)
+
+var unclosedThink = regexp.MustCompile(`(?s)<think>.*$`)
+
+// visibleText is what the user should see of a partial answer: finished and
+// still open <think> blocks are hidden
+func visibleText(partial string) string {
+	return strings.TrimSpace(unclosedThink.ReplaceAllString(removeThinkTags(partial), ""))
+}
+
+// SendMessage sends msg to chat, counting it in the metrics
+func (a *Account) SendMessage(ctx context.Context, chat types.JID, msg *waE2E.Message) (whatsmeow.SendResponse, error) {
+	resp, err := a.Client().SendMessage(ctx, chat, msg)
+	if err != nil {
+		sendErrors.Inc(chatType(chat))
+	} else {
+		messagesSent.Inc(chatType(chat))
+	}
+	return resp, err
+}
+
+// SendText sends a plain text message to chat
+func (a *Account) SendText(chat types.JID, text string) error {
+	_, err := a.SendMessage(context.Background(), chat, &waE2E.Message{
+		Conversation: &text,
+	})
+	return err
+}
+
+// StreamReply delivers an answer to chat while it is being generated: the first
+// piece is sent as a new message, later pieces edit that message.
+type StreamReply struct {
+	account *Account
+	chat    types.JID
+
+	mu       sync.Mutex
+	msgID    types.MessageID // empty until the first message is sent
+	sent     string          // text of the message as the user sees it now
+	lastEdit time.Time
+	done     chan struct{}
+}
+
+// NewStreamReply shows "typing…" in chat until Finish is called
+func (a *Account) NewStreamReply(chat types.JID) *StreamReply {
+	r := &StreamReply{account: a, chat: chat, done: make(chan struct{})}
+	go r.keepTyping()
+	return r
+}
+
+func (r *StreamReply) keepTyping() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for {
+		r.account.Client().SendChatPresence(r.chat, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+		select {
+		case <-r.done:
+			r.account.Client().SendChatPresence(r.chat, types.ChatPresencePaused, types.ChatPresenceMediaText)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update shows the answer generated so far, at most once every editInterval
+func (r *StreamReply) Update(partial string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.msgID != "" && time.Since(r.lastEdit) < editInterval {
+		return
+	}
+	r.show(visibleText(partial))
+}
+
+// Finish shows the complete answer and stops "typing…"
+func (r *StreamReply) Finish(text string) {
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.show(text)
+}
+
+func (r *StreamReply) show(text string) {
+	if text == "" || text == r.sent {
+		return
+	}
+	content := &waE2E.Message{Conversation: &text}
+	if r.msgID == "" {
+		resp, err := r.account.SendMessage(context.Background(), r.chat, content)
+		if err != nil {
+			log.Printf("Failed to send reply to %s: %v", r.chat, err)
+			return
+		}
+		r.msgID = resp.ID
+	} else {
+		client := r.account.Client()
+		_, err := client.SendMessage(context.Background(), r.chat, client.BuildEdit(r.chat, r.msgID, content))
+		if err != nil {
+			log.Printf("Failed to edit reply to %s: %v", r.chat, err)
+			return
+		}
+	}
+	r.sent = text
+	r.lastEdit = time.Now()
+}
+
+// ReplyAI answers userMessage of someone with level in the conversation historyJID,
+// in chat: as streamed text, or as a voice note if the chat turned voice replies on
+func (a *Account) ReplyAI(chat types.JID, historyJID string, level Level, userMessage ChatMessage) {
+	if a.voiceReplies(chat) {
+		a.VoiceChatAI(chat, historyJID, level, userMessage)
+		return
+	}
+	a.StreamChatAI(chat, historyJID, level, userMessage)
+}
+
+// StreamChatAI answers userMessage in the conversation historyJID, streaming the reply to chat
+func (a *Account) StreamChatAI(chat types.JID, historyJID string, level Level, userMessage ChatMessage) {
+	reply := a.NewStreamReply(chat)
+	var partial strings.Builder
+	answer, err := ChatAIStream(historyJID, a.PersonaOf(chat), level, userMessage, func(token string) {
+		partial.WriteString(token)
+		reply.Update(partial.String())
+	})
+	if err != nil {
+		log.Printf("AI chat for %s failed: %v", historyJID, err)
+		answer = aiErrorReply(err)
+		if partial.Len() > 0 {
+			// Keep what was already shown and say it was cut short
+			answer = visibleText(partial.String()) + "\n\n[" + answer + "]"
+		}
+	}
+	reply.Finish(answer)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	aiAttempts     = 3               // Tries per AI request before giving up
+	aiFirstBackoff = 2 * time.Second // Wait before the second try, doubled for every further try
+)
+
+// noRetry marks an error that must not be retried, whatever its cause
+type noRetry struct{ error }
+
+func (e noRetry) Unwrap() error { return e.error }
+
+// retryable reports whether an AI request that failed with err is worth sending again
+func retryable(err error) bool {
+	if errors.As(err, new(noRetry)) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	return errors.Is(err, ErrBackendUnavailable)
+}
+
+// withRetries runs call until it succeeds, fails with a permanent error or
+// runs out of attempts, waiting longer after every failure
+func withRetries(what string, call func() error) error {
+	backoff := aiFirstBackoff
+	var err error
+	for attempt := 1; attempt <= aiAttempts; attempt++ {
+		err = call()
+		if err == nil || !retryable(err) || attempt == aiAttempts {
+			break
+		}
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %v", what, attempt, aiAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// aiErrorReply is the WhatsApp answer sent instead of a reply when the AI request failed
+func aiErrorReply(err error) string {
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, ErrBackendUnavailable):
+		return "AI backend unavailable, please try again later."
+	case errors.As(err, &statusErr) && statusErr.Temporary():
+		return "AI backend is busy, please try again later."
+	}
+	return "Internal AI error"
+}
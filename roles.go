@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const rolesSchema = `
+CREATE TABLE IF NOT EXISTS roles (
+	account    TEXT NOT NULL DEFAULT '',
+	jid        TEXT NOT NULL,
+	role       TEXT NOT NULL,
+	granted_by TEXT NOT NULL,
+	granted_at INTEGER NOT NULL,
+	PRIMARY KEY (account, jid)
+);
+`
+
+// Before the accounts a contact had one role, for the only account
+const rolesMigration = `
+CREATE TABLE roles_accounts (
+	account    TEXT NOT NULL DEFAULT '',
+	jid        TEXT NOT NULL,
+	role       TEXT NOT NULL,
+	granted_by TEXT NOT NULL,
+	granted_at INTEGER NOT NULL,
+	PRIMARY KEY (account, jid)
+);
+INSERT INTO roles_accounts (account, jid, role, granted_by, granted_at) SELECT '', jid, role, granted_by, granted_at FROM roles;
+DROP TABLE roles;
+ALTER TABLE roles_accounts RENAME TO roles;
+`
+
+// RoleStore keeps the role granted to each contact on each account, by account
+// key. The configured numbers are always owner and are not stored.
+type RoleStore struct {
+	db *sql.DB
+}
+
+// RoleEntry is a stored role, as listed by the roles command
+type RoleEntry struct {
+	JID       types.JID
+	Level     Level
+	GrantedBy types.JID
+	GrantedAt time.Time
+}
+
+var roles *RoleStore
+
+func NewRoleStore(db *sql.DB) (*RoleStore, error) {
+	if _, err := db.Exec(rolesSchema); err != nil {
+		return nil, fmt.Errorf("create roles table: %w", err)
+	}
+	var migrated bool
+	if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info('roles') WHERE name = 'account'`).Scan(&migrated); err != nil {
+		return nil, fmt.Errorf("read columns of roles: %w", err)
+	}
+	if !migrated {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(rolesMigration); err != nil {
+			return nil, fmt.Errorf("add account to roles: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("add account to roles: %w", err)
+		}
+	}
+	return &RoleStore{db: db}, nil
+}
+
+// isConfiguredOwner reports whether jid is the number of the configuration file
+func isConfiguredOwner(jid types.JID) bool {
+	return config.Number != "" && jid.User == config.Number && jid.Server == types.DefaultUserServer
+}
+
+// LevelOf returns the level of a contact on account
+func (r *RoleStore) LevelOf(account string, jid types.JID) Level {
+	jid = jid.ToNonAD()
+	if isConfiguredOwner(jid) {
+		return LevelOwner
+	}
+	var role string
+	err := r.db.QueryRow(`SELECT role FROM roles WHERE account = ? AND jid = ?`, account, jid.String()).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LevelNone
+	} else if err != nil {
+		log.Printf("Cannot read the role of %s: %v", jid, err)
+		return LevelNone
+	}
+	level, err := ParseRole(role)
+	if err != nil {
+		log.Printf("Stored role of %s: %v", jid, err)
+		return LevelNone
+	}
+	return level
+}
+
+// Grant gives level to jid on account, replacing its previous role
+func (r *RoleStore) Grant(account string, jid types.JID, level Level, by types.JID) error {
+	_, err := r.db.Exec(`
+		INSERT INTO roles (account, jid, role, granted_by, granted_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(account, jid) DO UPDATE SET role = excluded.role, granted_by = excluded.granted_by, granted_at = excluded.granted_at`,
+		account, jid.ToNonAD().String(), level.String(), by.ToNonAD().String(), time.Now().Unix())
+	return err
+}
+
+// Revoke removes the role of jid on account and reports whether it had one
+func (r *RoleStore) Revoke(account string, jid types.JID) (bool, error) {
+	res, err := r.db.Exec(`DELETE FROM roles WHERE account = ? AND jid = ?`, account, jid.ToNonAD().String())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// List returns every role stored on account, highest first
+func (r *RoleStore) List(account string) ([]RoleEntry, error) {
+	rows, err := r.db.Query(`SELECT jid, role, granted_by, granted_at FROM roles WHERE account = ? ORDER BY jid`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []RoleEntry
+	for rows.Next() {
+		var jid, role, grantedBy string
+		var grantedAt int64
+		if err := rows.Scan(&jid, &role, &grantedBy, &grantedAt); err != nil {
+			return nil, err
+		}
+		entry := RoleEntry{GrantedAt: time.Unix(grantedAt, 0)}
+		entry.JID, _ = types.ParseJID(jid)
+		entry.GrantedBy, _ = types.ParseJID(grantedBy)
+		if entry.Level, err = ParseRole(role); err != nil {
+			log.Printf("Stored role of %s: %v", jid, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Level > entries[j].Level })
+	return entries, rows.Err()
+}
+
+// ParseContact accepts a phone number ("+39 333 4455666", "393334455666") or a full JID
+func ParseContact(arg string) (types.JID, error) {
+	if strings.Contains(arg, "@") {
+		return types.ParseJID(arg)
+	}
+	number := strings.NewReplacer("+", "", " ", "", "-", "").Replace(arg)
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return types.JID{}, fmt.Errorf("%q is not a phone number", arg)
+	}
+	return types.NewJID(number, types.DefaultUserServer), nil
+}
+
+// canManage reports whether the sender of ctx may change the role of a contact at target.
+// Roles can only be managed below one's own level; the configured owners of the account
+// can manage everyone.
+func canManage(ctx *CommandContext, target Level) bool {
+	return isConfiguredOwner(ctx.Sender) || ctx.Account.IsOwner(ctx.Sender) || target < ctx.Level
+}
+
+// isAccountOwner reports whether jid is owner of the account by configuration, and cannot be given a role
+func isAccountOwner(a *Account, jid types.JID) bool {
+	return isConfiguredOwner(jid.ToNonAD()) || a.IsOwner(jid)
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "grant",
+		Args:    "<number> <role>",
+		Help:    "give a role to a contact: blocked, user, admin or owner",
+		Level:   LevelAdmin,
+		MinArgs: 2,
+		MaxArgs: 2,
+		Run: func(ctx *CommandContext) {
+			jid, err := ParseContact(ctx.Args[0])
+			if err != nil {
+				ctx.Reply(err.Error())
+				return
+			}
+			level, err := ParseRole(ctx.Args[1])
+			if err != nil {
+				ctx.Reply(err.Error())
+				return
+			}
+			if isAccountOwner(ctx.Account, jid) {
+				ctx.Reply(jid.User + " is the owner set in the configuration.")
+				return
+			}
+			if !canManage(ctx, ctx.Account.LevelOf(jid)) || !canManage(ctx, level) {
+				ctx.Reply("You can only manage roles below " + ctx.Level.String() + ".")
+				return
+			}
+			if err := roles.Grant(ctx.Account.Key(), jid, level, ctx.Sender); err != nil {
+				log.Printf("Cannot grant %s to %s: %v", level, jid, err)
+				ctx.Reply("Cannot save the role, see the log.")
+				return
+			}
+			ctx.Reply(jid.User + " is now " + level.String() + ".")
+		},
+	})
+	RegisterCommand(&Command{
+		Name:    "revoke",
+		Args:    "<number>",
+		Help:    "remove the role of a contact",
+		Level:   LevelAdmin,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			jid, err := ParseContact(ctx.Args[0])
+			if err != nil {
+				ctx.Reply(err.Error())
+				return
+			}
+			if isAccountOwner(ctx.Account, jid) {
+				ctx.Reply(jid.User + " is the owner set in the configuration.")
+				return
+			}
+			if !canManage(ctx, ctx.Account.LevelOf(jid)) {
+				ctx.Reply("You can only manage roles below " + ctx.Level.String() + ".")
+				return
+			}
+			revoked, err := roles.Revoke(ctx.Account.Key(), jid)
+			if err != nil {
+				log.Printf("Cannot revoke the role of %s: %v", jid, err)
+				ctx.Reply("Cannot remove the role, see the log.")
+			} else if !revoked {
+				ctx.Reply(jid.User + " has no role.")
+			} else {
+				ctx.Reply(jid.User + " has no role anymore.")
+			}
+		},
+	})
+	RegisterCommand(&Command{
+		Name:  "roles",
+		Help:  "list the contacts with a role",
+		Level: LevelAdmin,
+		Run: func(ctx *CommandContext) {
+			entries, err := roles.List(ctx.Account.Key())
+			if err != nil {
+				log.Printf("Cannot list roles: %v", err)
+				ctx.Reply("Cannot list roles, see the log.")
+				return
+			}
+			reply := ctx.Account.Number + " - owner (configuration)"
+			if config.Number != "" && config.Number != ctx.Account.Number {
+				reply += "\n" + config.Number + " - owner of every account (configuration)"
+			}
+			for _, entry := range entries {
+				reply += "\n" + entry.JID.User + " - " + entry.Level.String() + " (by " + entry.GrantedBy.User + ", " + entry.GrantedAt.Format("2006-01-02") + ")"
+			}
+			ctx.Reply(reply)
+		},
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import "log"
+
+// Conventions of the other bots sharing the owner's chat, see routing in the configuration
+
+func init() {
+	RegisterRoute(Route{
+		Name:  "ignore",
+		Level: LevelOwner,
+		Match: func(text string) bool { return matchesAny(text, config.Routing.Ignore) },
+		Run: func(ctx *CommandContext) { //ignore. AQI Chatbot will reply
+			log.Print("Reading status, ignoring")
+		},
+	})
+	RegisterRoute(Route{
+		Name:  "ignore-prefix",
+		Level: LevelOwner,
+		Match: func(text string) bool { return hasAnyPrefix(text, config.Routing.IgnorePrefixes) },
+		Run: func(ctx *CommandContext) {
+			log.Print("Ignoring alarm from AQI")
+		},
+	})
+	RegisterRoute(Route{
+		Name:  "generate",
+		Level: LevelOwner,
+		Match: func(text string) bool { return hasAnyPrefix(text, config.Routing.GeneratePrefixes) },
+		Run: func(ctx *CommandContext) {
+			log.Print("Internal request: stock evaluation")
+			reply, err := GenerateAI(ctx.Account.PersonaOf(ctx.Chat).Model, ctx.Text) //single generation task
+			if err != nil {
+				log.Printf("AI generate failed: %v", err)
+				reply = aiErrorReply(err)
+			}
+			ctx.Reply(reply)
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const settingsSchema = `
+CREATE TABLE IF NOT EXISTS chat_settings (
+	jid   TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (jid, key)
+);
+`
+
+// SettingsStore keeps per-chat settings set with commands, e.g. whether the bot answers in a group
+type SettingsStore struct {
+	db *sql.DB
+}
+
+var settings *SettingsStore
+
+func NewSettingsStore(db *sql.DB) (*SettingsStore, error) {
+	if _, err := db.Exec(settingsSchema); err != nil {
+		return nil, fmt.Errorf("create chat_settings table: %w", err)
+	}
+	return &SettingsStore{db: db}, nil
+}
+
+// Get returns the value of key for chat, and whether it was set
+func (s *SettingsStore) Get(chat types.JID, key string) (string, bool) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM chat_settings WHERE jid = ? AND key = ?`, chat.ToNonAD().String(), key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false
+	} else if err != nil {
+		log.Printf("Cannot read setting %s of %s: %v", key, chat, err)
+		return "", false
+	}
+	return value, true
+}
+
+// GetBool returns the value of an on/off setting, or def if it was never set
+func (s *SettingsStore) GetBool(chat types.JID, key string, def bool) bool {
+	value, ok := s.Get(chat, key)
+	if !ok {
+		return def
+	}
+	return value == "on"
+}
+
+func (s *SettingsStore) Set(chat types.JID, key, value string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO chat_settings (jid, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(jid, key) DO UPDATE SET value = excluded.value`, chat.ToNonAD().String(), key, value)
+	return err
+}
+
+func (s *SettingsStore) SetBool(chat types.JID, key string, value bool) error {
+	if value {
+		return s.Set(chat, key, "on")
+	}
+	return s.Set(chat, key, "off")
+}
+
+// Delete goes back to the default value of key for chat
+func (s *SettingsStore) Delete(chat types.JID, key string) error {
+	_, err := s.db.Exec(`DELETE FROM chat_settings WHERE jid = ? AND key = ?`, chat.ToNonAD().String(), key)
+	return err
+}
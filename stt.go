@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+const transcribeTimeout = 5 * time.Minute
+
+// Transcriber turns speech into text. Audio is 16 kHz mono WAV, what whisper expects.
+type Transcriber interface {
+	Transcribe(ctx context.Context, wav []byte) (string, error)
+}
+
+var transcriber Transcriber // nil when speech to text is off
+
+// NewTranscriber returns the engine selected in the speech_to_text configuration, or nil if it is off
+func NewTranscriber(cfg SpeechToTextConfig) (Transcriber, error) {
+	switch strings.ToLower(cfg.Engine) {
+	case "":
+		return nil, nil
+	case "whisper-cpp":
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("speech_to_text: whisper-cpp needs a model file")
+		}
+		return &WhisperCppTranscriber{Binary: cfg.Binary, Model: cfg.Model, Language: cfg.Language}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("speech_to_text: http needs a url")
+		}
+		return &HTTPTranscriber{URL: cfg.URL, Model: cfg.Model, Language: cfg.Language}, nil
+	}
+	return nil, fmt.Errorf("speech_to_text: unknown engine %q (use whisper-cpp or http)", cfg.Engine)
+}
+
+// WhisperCppTranscriber runs the whisper.cpp command line tool
+type WhisperCppTranscriber struct {
+	Binary   string // whisper-cli, or main in older whisper.cpp releases
+	Model    string // ggml model file
+	Language string
+}
+
+func (w *WhisperCppTranscriber) Transcribe(ctx context.Context, wav []byte) (string, error) {
+	file, err := os.CreateTemp("", "voice-*.wav")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(wav); err != nil {
+		file.Close()
+		return "", err
+	}
+	file.Close()
+
+	args := []string{"-m", w.Model, "-f", file.Name(), "-nt", "-np"}
+	if w.Language != "" {
+		args = append(args, "-l", w.Language)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, w.Binary, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", w.Binary, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Join(strings.Fields(string(output)), " "), nil
+}
+
+// HTTPTranscriber posts the audio as multipart "file" to a transcription server:
+// the whisper.cpp server (/inference) or an OpenAI-compatible one (/v1/audio/transcriptions)
+type HTTPTranscriber struct {
+	URL      string
+	Model    string
+	Language string
+}
+
+func (h *HTTPTranscriber) Transcribe(ctx context.Context, wav []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "voice.wav")
+	if err != nil {
+		return "", err
+	}
+	part.Write(wav)
+	form.WriteField("response_format", "json")
+	if h.Model != "" {
+		form.WriteField("model", h.Model)
+	}
+	if h.Language != "" {
+		form.WriteField("language", h.Language)
+	}
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("%s returned %s: %s", h.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("parse transcription: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// ffmpeg converts input with ffmpeg, reading it from stdin. The output goes to
+// a temporary file with extension ext rather than a pipe, so that ffmpeg can
+// seek back and write proper headers.
+func ffmpeg(ctx context.Context, input []byte, ext string, args ...string) ([]byte, error) {
+	out, err := os.CreateTemp("", "convert-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	var stderr bytes.Buffer
+	args = append(append([]string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}, args...), "-y", out.Name())
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(out.Name())
+}
+
+// transcribeVoice downloads a voice note and returns what was said
+func transcribeVoice(account *Account, audio *waE2E.AudioMessage) (string, error) {
+	ogg, err := account.Client().Download(audio)
+	if err != nil {
+		return "", fmt.Errorf("download voice note: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transcribeTimeout)
+	defer cancel()
+	// WhatsApp voice notes are opus in ogg, whisper wants 16 kHz mono WAV
+	wav, err := ffmpeg(ctx, ogg, ".wav", "-ar", "16000", "-ac", "1")
+	if err != nil {
+		return "", err
+	}
+	text, err := transcriber.Transcribe(ctx, wav)
+	if err != nil {
+		return "", fmt.Errorf("transcribe voice note: %w", err)
+	}
+	return text, nil
+}
+
+// voiceToText replaces a voice note with its transcript, as if it were typed.
+// It reports false, after telling the sender, if the voice note cannot be understood.
+func voiceToText(ctx *CommandContext) (string, bool) {
+	audio := ctx.Event.Message.GetAudioMessage()
+	text, err := transcribeVoice(ctx.Account, audio)
+	if err != nil {
+		log.Printf("Voice note from %s: %v", ctx.Sender, err)
+		ctx.Reply("Sorry, I could not understand your voice note.")
+		return "", false
+	}
+	if text == "" {
+		ctx.Reply("I heard nothing in your voice note.")
+		return "", false
+	}
+	log.Printf("Voice note from %s: %s", ctx.Sender, text)
+	if config.SpeechToText.EchoTranscript {
+		ctx.Reply("🎤 " + text)
+	}
+	return text, true
+}
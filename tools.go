@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tools are Go functions the model can call while answering. Like commands,
+// each tool needs a minimum level: the model acts with the level of the person
+// it is answering, so a user cannot reach an admin tool by asking nicely.
+
+// Tool is a function the model may call
+type Tool struct {
+	Name        string
+	Description string                 // Tells the model when to call it
+	Parameters  map[string]interface{} // JSON schema of the arguments; nil for none
+	Level       Level                  // Tools that reveal or change the system need LevelAdmin or more
+	Run         func(args map[string]interface{}) (string, error)
+}
+
+var (
+	tools     = make(map[string]*Tool)
+	toolNames []string // Sorted, for help and a stable tool list
+
+	noToolModels sync.Map // Models that refused tools, asked without them from then on
+)
+
+// RegisterTool makes tool available to the model; call it from an init function
+func RegisterTool(tool *Tool) {
+	if _, exists := tools[tool.Name]; exists {
+		panic("tool registered twice: " + tool.Name)
+	}
+	if tool.Parameters == nil {
+		tool.Parameters = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	}
+	tools[tool.Name] = tool
+	toolNames = append(toolNames, tool.Name)
+	sort.Strings(toolNames)
+}
+
+// toolSpecs returns the tools the model may call for someone with level, for model
+func toolSpecs(level Level, model string) []ToolSpec {
+	if !config.Tools.Enabled {
+		return nil
+	}
+	if _, refused := noToolModels.Load(model); refused {
+		return nil
+	}
+	var specs []ToolSpec
+	for _, name := range toolNames {
+		if tool := tools[name]; level >= tool.Level {
+			specs = append(specs, ToolSpec{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters})
+		}
+	}
+	return specs
+}
+
+// runTool runs call for the conversation jid, checking level again: the model may
+// call a tool it was not offered. The result, or the error, goes back to the model.
+func runTool(jid string, level Level, call ToolCall) ChatMessage {
+	name := call.Function.Name
+	result := ChatMessage{Role: "tool", ToolName: name, ToolCallID: call.ID}
+	tool, ok := tools[name]
+	switch {
+	case !ok:
+		result.Content = "Error: there is no tool named " + name
+	case level < tool.Level:
+		log.Printf("Tool %s denied to %s (%s)", name, jid, level)
+		result.Content = "Error: permission denied, " + name + " needs the " + tool.Level.String() + " role"
+	default:
+		args, _ := json.Marshal(call.Function.Arguments)
+		log.Printf("Tool %s for %s: %s", name, jid, args)
+		output, err := tool.Run(call.Function.Arguments)
+		if err != nil {
+			log.Printf("Tool %s failed: %v", name, err)
+			output = "Error: " + err.Error()
+		}
+		result.Content = output
+	}
+	return result
+}
+
+// stringArg returns the string argument name, or def if the model did not give it
+func stringArg(args map[string]interface{}, name, def string) string {
+	if s, ok := args[name].(string); ok && s != "" {
+		return s
+	}
+	return def
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "tools",
+		Help:  "what the AI can look up for you while answering",
+		Level: LevelUser,
+		Run: func(ctx *CommandContext) {
+			if !config.Tools.Enabled {
+				ctx.Reply("Tools are turned off on this bot.")
+				return
+			}
+			var sb strings.Builder
+			sb.WriteString("Ask me and I can use:")
+			for _, name := range toolNames {
+				if tool := tools[name]; ctx.Level >= tool.Level {
+					sb.WriteString(fmt.Sprintf("\n• %s: %s", tool.Name, tool.Description))
+				}
+			}
+			ctx.Reply(sb.String())
+		},
+	})
+}
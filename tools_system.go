@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Tools that look at the Raspberry itself
+
+func init() {
+	RegisterTool(&Tool{
+		Name:        "network_info",
+		Description: "Network interfaces and IP addresses of the Raspberry, and its public IP and location",
+		Level:       LevelAdmin,
+		Run: func(args map[string]interface{}) (string, error) {
+			return IpConf() + "\nPublic IP:\n" + publicIPInfo(), nil
+		},
+	})
+	RegisterTool(&Tool{
+		Name:        "uptime",
+		Description: "How long the Raspberry has been running, and its load average",
+		Level:       LevelUser,
+		Run: func(args map[string]interface{}) (string, error) {
+			data, err := os.ReadFile("/proc/uptime")
+			if err != nil {
+				return "", err
+			}
+			fields := strings.Fields(string(data))
+			if len(fields) == 0 {
+				return "", fmt.Errorf("unexpected /proc/uptime %q", data)
+			}
+			seconds, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return "", err
+			}
+			result := "Up for " + (time.Duration(seconds) * time.Second).String()
+			if load, err := os.ReadFile("/proc/loadavg"); err == nil && len(strings.Fields(string(load))) >= 3 {
+				result += "\nLoad average (1, 5, 15 min): " + strings.Join(strings.Fields(string(load))[:3], " ")
+			}
+			return result, nil
+		},
+	})
+	RegisterTool(&Tool{
+		Name:        "disk_usage",
+		Description: "Size, used and free space of the file system holding a path",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"path": map[string]interface{}{"type": "string", "description": "A path on the file system, / if not given"},
+			},
+		},
+		Level: LevelUser,
+		Run: func(args map[string]interface{}) (string, error) {
+			path := stringArg(args, "path", "/")
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(path, &fs); err != nil {
+				return "", err
+			}
+			total := fs.Blocks * uint64(fs.Bsize)
+			free := fs.Bavail * uint64(fs.Bsize)
+			if total == 0 {
+				return path + ": empty file system", nil
+			}
+			used := total - fs.Bfree*uint64(fs.Bsize)
+			return fmt.Sprintf("%s: %.1f GB total, %.1f GB used (%.0f%%), %.1f GB free",
+				path, gigabytes(total), gigabytes(used), 100*float64(used)/float64(total), gigabytes(free)), nil
+		},
+	})
+	RegisterTool(&Tool{
+		Name:        "sensors",
+		Description: "Temperatures measured by the Raspberry's sensors, such as the CPU temperature",
+		Level:       LevelUser,
+		Run: func(args map[string]interface{}) (string, error) {
+			zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*")
+			var readings []string
+			for _, zone := range zones {
+				temp, err := os.ReadFile(filepath.Join(zone, "temp"))
+				if err != nil {
+					continue
+				}
+				milli, err := strconv.Atoi(strings.TrimSpace(string(temp)))
+				if err != nil {
+					continue
+				}
+				name := filepath.Base(zone)
+				if kind, err := os.ReadFile(filepath.Join(zone, "type")); err == nil {
+					name = strings.TrimSpace(string(kind))
+				}
+				readings = append(readings, fmt.Sprintf("%s: %.1f °C", name, float64(milli)/1000))
+			}
+			if len(readings) == 0 {
+				return "No temperature sensors found", nil
+			}
+			return strings.Join(readings, "\n"), nil
+		},
+	})
+}
+
+func gigabytes(bytes uint64) float64 {
+	return float64(bytes) / (1 << 30)
+}
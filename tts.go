@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	synthesizeTimeout = 5 * time.Minute
+	voiceSetting      = "voice.replies"
+)
+
+// Synthesizer turns text into speech, in any audio format ffmpeg can read
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string) ([]byte, error)
+}
+
+var synthesizer Synthesizer // nil when text to speech is off
+
+// NewSynthesizer returns the engine selected in the text_to_speech configuration, or nil if it is off
+func NewSynthesizer(cfg TextToSpeechConfig) (Synthesizer, error) {
+	switch strings.ToLower(cfg.Engine) {
+	case "":
+		return nil, nil
+	case "piper":
+		if cfg.Model == "" {
+			return nil, fmt.Errorf("text_to_speech: piper needs a model file")
+		}
+		return &PiperSynthesizer{Binary: cfg.Binary, Model: cfg.Model}, nil
+	case "http", "openai":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("text_to_speech: %s needs a url", cfg.Engine)
+		}
+		return &HTTPSynthesizer{URL: cfg.URL, OpenAI: strings.EqualFold(cfg.Engine, "openai"), Model: cfg.Model, Voice: cfg.Voice}, nil
+	}
+	return nil, fmt.Errorf("text_to_speech: unknown engine %q (use piper, http or openai)", cfg.Engine)
+}
+
+// PiperSynthesizer runs the piper command line tool
+type PiperSynthesizer struct {
+	Binary string
+	Model  string // .onnx voice file
+}
+
+func (p *PiperSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	file, err := os.CreateTemp("", "speech-*.wav")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Binary, "--model", p.Model, "--output_file", file.Name())
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", p.Binary, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(file.Name())
+}
+
+// HTTPSynthesizer posts the text to a speech server: as a plain text body (piper's
+// http_server), or as JSON to an OpenAI-compatible /v1/audio/speech endpoint
+type HTTPSynthesizer struct {
+	URL    string
+	OpenAI bool
+	Model  string
+	Voice  string
+}
+
+func (h *HTTPSynthesizer) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	var body io.Reader = strings.NewReader(text)
+	contentType := "text/plain; charset=utf-8"
+	if h.OpenAI {
+		payload, err := json.Marshal(map[string]string{
+			"model":           h.Model,
+			"voice":           h.Voice,
+			"input":           text,
+			"response_format": "wav",
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = bytes.NewReader(payload), "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", h.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// wavSeconds estimates the length of a WAV file from its header, 0 if unknown
+func wavSeconds(wav []byte) uint32 {
+	if len(wav) < 44 || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" {
+		return 0
+	}
+	byteRate := binary.LittleEndian.Uint32(wav[28:32])
+	if byteRate == 0 {
+		return 0
+	}
+	return uint32((len(wav) - 44) / int(byteRate))
+}
+
+// speakable removes what should not be read aloud: hidden reasoning and markdown marks
+func speakable(text string) string {
+	return strings.NewReplacer("*", "", "_", "", "#", "", "`", "").Replace(removeThinkTags(text))
+}
+
+// SendVoice synthesizes text and sends it to chat as a voice note (PTT)
+func (a *Account) SendVoice(chat types.JID, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), synthesizeTimeout)
+	defer cancel()
+	speech, err := synthesizer.Synthesize(ctx, speakable(text))
+	if err != nil {
+		return fmt.Errorf("synthesize: %w", err)
+	}
+	// WhatsApp plays voice notes as mono opus in ogg
+	ogg, err := ffmpeg(ctx, speech, ".ogg", "-c:a", "libopus", "-b:a", "32k", "-ac", "1", "-ar", "48000", "-application", "voip")
+	if err != nil {
+		return err
+	}
+	uploaded, err := a.Client().Upload(ctx, ogg, whatsmeow.MediaAudio)
+	if err != nil {
+		return fmt.Errorf("upload voice note: %w", err)
+	}
+	_, err = a.SendMessage(ctx, chat, &waE2E.Message{
+		AudioMessage: &waE2E.AudioMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("audio/ogg; codecs=opus"),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(ogg))),
+			Seconds:       proto.Uint32(wavSeconds(speech)),
+			PTT:           proto.Bool(true),
+		},
+	})
+	return err
+}
+
+// voiceReplies reports whether chat wants its answers as voice notes
+func (a *Account) voiceReplies(chat types.JID) bool {
+	return synthesizer != nil && settings.GetBool(chat, a.SettingKey(voiceSetting), false)
+}
+
+// VoiceChatAI answers userMessage in the conversation historyJID with a voice note sent to chat.
+// If speech cannot be produced, the answer is sent as text.
+func (a *Account) VoiceChatAI(chat types.JID, historyJID string, level Level, userMessage ChatMessage) {
+	a.Client().SendChatPresence(chat, types.ChatPresenceComposing, types.ChatPresenceMediaAudio)
+	defer a.Client().SendChatPresence(chat, types.ChatPresencePaused, types.ChatPresenceMediaAudio)
+
+	answer, err := ChatAIStream(historyJID, a.PersonaOf(chat), level, userMessage, nil)
+	if err != nil {
+		log.Printf("AI chat for %s failed: %v", historyJID, err)
+		a.SendText(chat, aiErrorReply(err))
+		return
+	}
+	if err := a.SendVoice(chat, answer); err != nil {
+		log.Printf("Cannot send voice reply to %s: %v", chat, err)
+		a.SendText(chat, answer)
+	}
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "voice",
+		Args:    "[on|off]",
+		Help:    "answer with voice notes instead of text in this chat",
+		Level:   LevelUser,
+		MaxArgs: 1,
+		Run: func(ctx *CommandContext) {
+			if synthesizer == nil {
+				ctx.Reply("Voice replies are not configured on this bot.")
+				return
+			}
+			if len(ctx.Args) == 0 {
+				if ctx.Account.voiceReplies(ctx.Chat) {
+					ctx.Reply("Voice replies are on. Send voice off for text.")
+				} else {
+					ctx.Reply("Voice replies are off. Send voice on to hear my answers.")
+				}
+				return
+			}
+			if ctx.Chat.Server == types.GroupServer && ctx.Level < LevelAdmin {
+				ctx.Reply("Only admins can change voice replies in a group.")
+				return
+			}
+			var on bool
+			switch strings.ToLower(ctx.Args[0]) {
+			case "on":
+				on = true
+			case "off":
+				on = false
+			default:
+				ctx.Reply("Usage: voice [on|off]")
+				return
+			}
+			if err := settings.SetBool(ctx.Chat, ctx.Account.SettingKey(voiceSetting), on); err != nil {
+				log.Printf("Cannot save voice setting of %s: %v", ctx.Chat, err)
+				ctx.Reply("Cannot save the setting, see the log.")
+				return
+			}
+			if on {
+				ctx.Reply("Voice replies on.")
+			} else {
+				ctx.Reply("Voice replies off.")
+			}
+		},
+	})
+}
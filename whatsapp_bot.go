@@ -5,97 +5,193 @@ import (
 	"context"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
 	"syscall"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/mdp/qrterminal"
-	"go.mau.fi/whatsmeow"
-	waE2E "go.mau.fi/whatsmeow/proto/waE2E"
-	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types/events"
-	waLog "go.mau.fi/whatsmeow/util/log"
-	"go.mau.fi/whatsmeow/types"
-	"io"
-	"net/http"
 	"fmt"
-	"encoding/json"
 	"strings"
 	"flag"
-	"bytes"
 	"net"
-	"bufio"
 	"regexp"
 )
 
-var WhatsmeowClient *whatsmeow.Client
-var wa_contact, password, model string
+var messageQueue = NewChatQueue() // Handles the messages of each chat one by one, in order
+var config Config
+var backend LLMBackend
 
 func main() {
-	flag.StringVar(&wa_contact, "number", "", "Whatsapp contact number without +, e.g., 393312345654")
-	flag.StringVar(&password, "password", "", "A secret word that allows any contact to receive sensor data")
-	flag.StringVar(&model, "model", "llama3", "Select a model, e.g.: deepseek-r1")
+	configPath := flag.String("config", "", "YAML configuration file, see config.example.yaml; flags override its values")
+	number := flag.String("number", "", "Whatsapp contact number without +, e.g., 393312345654")
+	password := flag.String("password", "", "A secret word that allows any contact to receive sensor data")
+	model := flag.String("model", "llama3", "Select a model, e.g.: deepseek-r1")
+	visionModel := flag.String("vision-model", "llava", "Model for conversations with images, e.g.: llava")
+	dbPath := flag.String("db", "chatbot.db", "SQLite file for conversation history")
+	backendKind := flag.String("backend", "ollama", "AI backend: ollama or openai (llama.cpp server, vLLM, LocalAI)")
+	backendURL := flag.String("backend-url", "", "AI backend base URL (default http://localhost:11434 for ollama, http://localhost:8080/v1 for openai)")
+	apiKey := flag.String("api-key", "", "Bearer token for the openai backend, if the server needs one")
+	pairPhone := flag.String("pair-phone", "", "The bot's own number without +: link it with a pairing code instead of the QR code")
 	flag.Parse()
 
-	WhatsmeowClient = CreateClient()
-	ConnectClient(WhatsmeowClient)
-	WhatsmeowClient.AddEventHandler(HandleEvent)
-	WhatsmeowClient.Connect()
+	var err error
+	config, err = LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Flags given on the command line win over the configuration file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "number":
+			config.Number = *number
+		case "password":
+			config.Password = *password
+		case "model":
+			config.Model = *model
+		case "vision-model":
+			config.VisionModel = *visionModel
+		case "db":
+			config.Database = *dbPath
+		case "backend":
+			config.Backend.Type = *backendKind
+		case "backend-url":
+			config.Backend.URL = *backendURL
+		case "api-key":
+			config.Backend.APIKey = *apiKey
+		case "pair-phone":
+			config.Pairing.Phone = *pairPhone
+		}
+	})
 
-	// Listen for Ctrl+C to gracefully shut down
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	WhatsmeowClient.Disconnect()
-}
+	if config.MQTT.Broker != "" {
+		if err := RegisterMQTTCommands(config.MQTT.Commands); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := AddCommandAliases(config.Commands); err != nil {
+		log.Fatalln(err)
+	}
+	if accounts, err = NewAccounts(config); err != nil {
+		log.Fatalln(err)
+	}
+	if flag.NArg() > 0 {
+		// accounts, pair <account> or remove <account>
+		if err := RunAccountCommand(flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
-func CreateClient() *whatsmeow.Client {
-	dbLog := waLog.Stdout("Database", "INFO", true)
-	container, err := sqlstore.New("sqlite3", "file:accounts.db?_foreign_keys=on", dbLog)
+	backend, err = NewBackend(config.Backend.Type, config.Backend.URL, config.Backend.APIKey)
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	deviceStore, err := container.GetFirstDevice()
+	botDB, err := OpenBotDB(config.Database)
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	clientLog := waLog.Stdout("Client", "INFO", true)
-	client := whatsmeow.NewClient(deviceStore, clientLog)
-
-	return client
-}
-
-func ConnectClient(client *whatsmeow.Client) {
-	if client.Store.ID == nil {
-		// No ID stored, new login, show a QR code
-		qrChan, _ := client.GetQRChannel(context.Background())
-		err := client.Connect()
+	defer botDB.Close()
+	history, err = NewHistoryStore(botDB, config.HistoryTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go history.ExpireLoop(time.Minute)
+	roles, err = NewRoleStore(botDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	invites, err = NewInviteStore(botDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	settings, err = NewSettingsStore(botDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	transcriber, err = NewTranscriber(config.SpeechToText)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	synthesizer, err = NewSynthesizer(config.TextToSpeech)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	documents, err = NewDocumentStore(botDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	reminders, err = NewReminderStore(botDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if config.MQTT.Broker != "" {
+		mqttBridge, err = NewMQTTBridge(config.MQTT)
 		if err != nil {
 			log.Fatalln(err)
 		}
-
-		for evt := range qrChan {
-			if evt.Event == "code" {
-				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
-			} else {
-				log.Println("Login event:", evt.Event)
-			}
+	}
+	if config.Knowledge.Dir != "" {
+		knowledge, err = NewKnowledgeBase(botDB, config.Knowledge.Dir, config.Knowledge.EmbeddingModel)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		go knowledge.IndexLoop(config.Knowledge.ReindexInterval)
+	}
+
+	if models, err := backend.ListModels(context.Background()); err != nil {
+		log.Printf("Cannot list models from AI backend: %v", err)
 	} else {
-		// Already logged in, just connect
-		err := client.Connect()
-		if err != nil {
+		log.Printf("AI backend models: %s", strings.Join(models, ", "))
+	}
+
+	for _, a := range accounts {
+		if err := a.NewClient(true); err != nil {
 			log.Fatalln(err)
 		}
 	}
+	if config.HTTP.Listen != "" {
+		go RunHTTPServer(config.HTTP.Listen)
+	}
+	// Ready once an account is connected, or before pairing, which waits for someone with the phone
+	go WatchdogLoop()
+	for _, a := range accounts {
+		if a.Client().Store.ID == nil {
+			notifyReady()
+			go a.Connect() // Pairing, the other accounts need not wait
+		} else {
+			a.Connect()
+		}
+	}
+	go reminders.Loop(20 * time.Second)
+	if mqttBridge != nil {
+		mqttBridge.Connect()
+	}
+
+	// Listen for Ctrl+C to gracefully shut down
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	sdNotify("STOPPING=1")
+	if mqttBridge != nil {
+		mqttBridge.Disconnect()
+	}
+	for _, a := range accounts {
+		a.Client().Disconnect()
+	}
 }
 
-func HandleEvent(evt interface{}) {
+// HandleEvent handles an event of the client of account
+func HandleEvent(account *Account, evt interface{}) {
 	switch v := evt.(type) {
 	case *events.Message:
-		go HandleMessage(v)
+		if !v.Info.IsFromMe {
+			messagesReceived.Inc(chatType(v.Info.Chat))
+		}
+		messageQueue.Run(account.HistoryKey(v.Info.Chat), func() {
+			HandleMessage(account, v)
+			markHandled()
+		})
+	default:
+		account.handleLifecycleEvent(evt)
 	}
 }
 
@@ -109,218 +205,203 @@ func removeThinkTags(text string) string {
 }
 
 
-var (
-	chatHistories = make(map[string][]map[string]string) // Stores conversation history per user
-	resetTimers   = make(map[string]*time.Timer)        // Stores reset timers per user
-	timeout       = time.Hour                           // 1 hour timeout duration
-)
+var history *HistoryStore // Stores conversation history per user
 
-func resetHistory(jid string) {
-	log.Printf("Chat history reset for %s due to inactivity.\n", jid)
-	delete(chatHistories, jid)  // Remove the chat history for this user
-	delete(resetTimers, jid)    // Remove the reset timer entry
-}
-
-func restartTimer(jid string) {
-	if timer, exists := resetTimers[jid]; exists {
-		timer.Stop() // Stop the previous timer
-	}
-	resetTimers[jid] = time.AfterFunc(timeout, func() {
-		resetHistory(jid)
+func GenerateAI(model, prompt string) (string, error) {
+	var response string
+	err := withRetries("AI generate", func() (err error) {
+		var usage Usage
+		start := time.Now()
+		response, usage, err = backend.Generate(context.Background(), model, prompt)
+		observeAI("generate", start, usage, err)
+		return err
 	})
+	if err != nil {
+		countAIError("generate", err)
+		return "", err
+	}
+	fmt.Println("Response from AI backend:")
+	fmt.Println(response)
+	response = removeThinkTags(response)
+	return response, nil //send back full response
 }
 
-func GenerateAI(prompt string)(string) {
-	// Define the API URL
-	apiURL := "http://localhost:11434/api/generate"
-
-	// Create the payload
-	//prompt := "Hello, how are you?"
-	model := model//"llama3" // Specify the model name
-	payload := map[string]string{
-		"model":  model,
-		"prompt": prompt,
-	}
+// ChatAIStream answers a user turn, which may carry images, in the conversation jid as persona
+// on behalf of someone with level, calling onToken with each piece of the answer as it is generated
+func ChatAIStream(jid string, persona Persona, level Level, userMessage ChatMessage, onToken func(token string)) (string, error) {
+	// One turn at a time per chat, so the history is never read and written concurrently
+	unlock := history.LockChat(jid)
+	defer unlock()
 
-	// Serialize payload to JSON
-	jsonPayload, err := json.Marshal(payload)
+	// Load the stored conversation and add the user's message
+	messages, err := history.History(jid)
 	if err != nil {
-		log.Fatalf("Failed to marshal payload: %v", err)
+		return "", fmt.Errorf("load chat history: %w", err)
 	}
-
-	// Make the POST request
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		log.Fatalf("Failed to make POST request: %v", err)
+	messages = append(messages, userMessage)
+	if docs := documentContext(jid, userMessage.Content); docs != "" {
+		messages = append([]ChatMessage{{Role: "system", Content: docs}}, messages...)
+	}
+	excerpts, sources := knowledgeContext(userMessage.Content)
+	if excerpts != "" {
+		messages = append([]ChatMessage{{Role: "system", Content: excerpts}}, messages...)
+	}
+	if persona.SystemPrompt != "" {
+		messages = append([]ChatMessage{{Role: "system", Content: persona.SystemPrompt}}, messages...)
 	}
-	defer resp.Body.Close()
 
-	// Handle streaming or non-standard JSON response
-	scanner := bufio.NewScanner(resp.Body)
-	fmt.Println("Response from Ollama:")
-	var response string
-	for scanner.Scan() {
-		line := scanner.Text()
-		var parsedLine map[string]interface{}
-		err := json.Unmarshal([]byte(line), &parsedLine)
+	// Send the full chat history with the persona's model, or the vision model once images are involved
+	req := ChatRequest{
+		Model:       persona.Model,
+		Messages:    messages,
+		Temperature: persona.Temperature,
+	}
+	if HasImages(messages) && persona.VisionModel != "" {
+		req.Model = persona.VisionModel
+	}
+	req.Tools = toolSpecs(level, req.Model)
+	var result ChatResponse
+	streamed := false
+	for round := 1; ; round++ {
+		err = withRetries("AI chat", func() (err error) {
+			start := time.Now()
+			defer func() { observeAI("chat", start, result.Usage, err) }()
+			if onToken != nil {
+				result, err = backend.ChatStream(context.Background(), req, func(token string) {
+					streamed = true
+					onToken(token)
+				})
+			} else {
+				result, err = backend.Chat(context.Background(), req)
+			}
+			if err != nil && streamed {
+				// Part of the answer already reached the user, a new try would repeat it
+				return noRetry{err}
+			}
+			return err
+		})
+		if err != nil && len(req.Tools) > 0 && toolsUnsupported(err) {
+			log.Printf("%s does not support tools, asking without them", req.Model)
+			noToolModels.Store(req.Model, true)
+			req.Tools = nil
+			continue
+		}
 		if err != nil {
-			// If parsing fails, assume it's plain text
-			fmt.Println(line)
-			return "Internal AI error"
-		} else if resp, ok := parsedLine["response"]; ok {
-			// Print human-readable response if "response" key exists
-			response=response+fmt.Sprintf("%v", resp) //resp is an interface{} type, so I must convert to string
-		} else {
-			// Print entire JSON object as fallback
-			fmt.Print(parsedLine)
-			return "Internal AI error"
+			countAIError("chat", err)
+			return "", err
+		}
+		if len(result.ToolCalls) == 0 || round > config.Tools.MaxRounds {
+			// Past the last round the model was given no tools: calls are ignored
+			break
+		}
+		// Run the tools and give the results back, until the model answers
+		req.Messages = append(req.Messages, ChatMessage{Role: "assistant", Content: result.Content, ToolCalls: result.ToolCalls})
+		for _, call := range result.ToolCalls {
+			req.Messages = append(req.Messages, runTool(jid, level, call))
+		}
+		if round >= config.Tools.MaxRounds {
+			req.Tools = nil // Enough tools, the next answer is the final one
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading response: %v", err)
-		return "Fatal AI error"
-	}
-	response = removeThinkTags(response)
-	return response//send back full response
-}
+	botResponse := result.Content
 
-func ChatAI(jid, prompt string) string {
-	apiURL := "http://localhost:11434/api/chat"
-
-	// Restart/reset the inactivity timer
-	restartTimer(jid)
+	// Store both turns; this also restarts the inactivity timeout
+	err = history.Append(jid, userMessage, ChatMessage{Role: "assistant", Content: botResponse})
+	if err != nil {
+		log.Printf("Failed to save chat history for %s: %v", jid, err)
+	}
 
-	// Ensure the chat history for this user exists
-	if _, exists := chatHistories[jid]; !exists {
-		chatHistories[jid] = []map[string]string{}
+	botResponse = removeThinkTags(botResponse)
+	if len(sources) > 0 {
+		botResponse += "\n\n📚 " + strings.Join(sources, ", ")
 	}
+	return botResponse, nil
+}
 
-	// Append the user's message to history
-	chatHistories[jid] = append(chatHistories[jid], map[string]string{
-		"role":    "user",
-		"content": prompt,
-	})
+func HandleMessage(account *Account, messageEvent *events.Message) {
+	chat := messageEvent.Info.Chat
+	senderJID := account.HistoryKey(chat) // Unique identifier for sender
+	messageContent := messageText(messageEvent)
 
-	// Create the full chat history payload
-	payload := map[string]interface{}{
-		"model":    model, // Use selected model
-		"messages": chatHistories[jid],
-		"stream":   false, // Full response instead of streaming
+	if messageEvent.Info.IsGroup {
+		HandleGroupMessage(account, messageEvent, messageContent)
+		return
 	}
-
-	// Serialize payload to JSON
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		log.Fatalf("Failed to marshal payload: %v", err)
+	if messageEvent.Info.IsFromMe {
+		return // Typed on the bot's own phone, to the contact of the chat: not a request of that contact
 	}
-
-	// Make the POST request
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		log.Fatalf("Failed to make POST request: %v", err)
+	if messageContent == "" && !hasMedia(messageEvent) {
+		return // Reactions, stickers and other messages without text
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Failed to read response: %v", err)
+	sender := messageEvent.Info.Sender.ToNonAD()
+	ctx := &CommandContext{Account: account, Event: messageEvent, Chat: chat, Sender: sender, Level: account.LevelOf(sender)}
+	switch ctx.Level {
+	case LevelBlocked:
+		return
+	case LevelNone: //external requests
+		if DispatchCommand(ctx, messageContent) { // join with an invite code
+			return
+		}
+		if config.Password == "" || !strings.HasPrefix(messageContent, config.Password) {
+			return
+		}
+		messageContent = strings.TrimSpace(messageContent[len(config.Password):])
+		if messageContent == "" && !hasMedia(messageEvent) {
+			return
+		}
+		ctx.Level = LevelUser
 	}
 
-	// Parse response JSON
-	var result map[string]interface{}
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		log.Fatalf("Failed to parse JSON response: %v", err)
+	if isVoice(messageEvent) {
+		var ok bool
+		if messageContent, ok = voiceToText(ctx); !ok {
+			return
+		}
 	}
-
-	// Extract assistant's response
-	botResponse := ""
-	if message, ok := result["message"].(map[string]interface{}); ok {
-		if content, exists := message["content"].(string); exists {
-			botResponse = content
+	if documentMessage(messageEvent.Message) != nil {
+		// The caption, if any, is a question about the document
+		if !ingestDocument(ctx, senderJID) || messageContent == "" {
+			return
 		}
 	}
-
-	// Append the assistant's response to chat history
-	chatHistories[jid] = append(chatHistories[jid], map[string]string{
-		"role":    "assistant",
-		"content": botResponse,
-	})
-	
-	botResponse = removeThinkTags(botResponse)
-	return botResponse
+	if DispatchCommand(ctx, messageContent) {
+		return
+	}
+	if ctx.Level == LevelOwner {
+		log.Print("Internal request: "+messageContent)
+	} else {
+		log.Printf("External request from %s (%s): %s", chat, ctx.Level, messageContent)
+	}
+	turn, err := userTurn(account, messageEvent, messageContent)
+	if err != nil {
+		log.Printf("Cannot read the message of %s: %v", chat, err)
+		ctx.Reply("Sorry, I could not download your attachment.")
+		return
+	}
+	account.ReplyAI(chat, senderJID, ctx.Level, turn) // Use sender's JID for history tracking
 }
 
-func HandleMessage(messageEvent *events.Message) {
-	recipientJID := types.NewJID(wa_contact, types.DefaultUserServer)
-	senderJID := messageEvent.Info.Chat.String() // Unique identifier for sender
-	var messageContent string
-
-	if messageEvent.Message.Conversation != nil {
-		messageContent = messageEvent.Message.GetConversation()
-	} else if messageEvent.Message.ExtendedTextMessage != nil {
-		messageContent = messageEvent.Message.ExtendedTextMessage.GetText()
+// hasAnyPrefix reports whether text starts with one of prefixes
+func hasAnyPrefix(text string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	if messageEvent.Info.Chat == recipientJID {
-		msg:=messageContent
-		switch strings.ToLower(msg) {
-		case "help":
-			reply := "Hi, I'm an AI assistant! Ask me anything."
-			WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-				Conversation: &reply,
-			})
-		case "ip":
-			reply := IpConf()
-			WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-				Conversation: &reply,
-			})
-			cmd := exec.Command("curl", "ipinfo.io")
-			output, _ := cmd.CombinedOutput()
-			reply = string(output)
-			WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-				Conversation: &reply,
-			})
-		case "reboot":
-			reply := "Rebooting the system... please wait."
-			WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-				Conversation: &reply,
-			})
-			cmd := exec.Command("reboot")
-			cmd.Run()
-		case "status": //ignore. AQI Chatbot will reply
-			log.Print("Reading status, ignoring")
-		default:
-			if strings.HasPrefix(messageContent, "LIVELLO"){
-				log.Print("Ignoring alarm from AQI")
-			}else if strings.HasPrefix(messageContent, "TITLE:"){
-				log.Print("Internal request: stock evaluation")
-				reply := GenerateAI(messageContent) //single generation task
-				WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-					Conversation: &reply,
-				})
-			}else{
-				log.Print("Internal request: "+messageContent)
-				reply := ChatAI(senderJID, messageContent) // Use sender's JID for history tracking
-				WhatsmeowClient.SendMessage(context.Background(), recipientJID, &waE2E.Message{
-					Conversation: &reply,
-				})
-			}
-		}
-	}else{ //external requests
-		if password != "" && strings.HasPrefix(messageContent, password) {
-			messageContent = messageContent[len(password)+1:]
-			log.Print("External request: "+messageContent)
-			reply := ChatAI(senderJID, messageContent) // Use sender's JID for history tracking
-			WhatsmeowClient.SendMessage(context.Background(), messageEvent.Info.Chat, &waE2E.Message{
-				Conversation: &reply,
-			})
+// matchesAny reports whether text is one of words, ignoring case
+func matchesAny(text string, words []string) bool {
+	for _, word := range words {
+		if strings.EqualFold(text, word) {
+			return true
 		}
 	}
+	return false
 }
 
-
 func IpConf() string {
 	interfaces, err := net.Interfaces()
 	if err != nil {